@@ -0,0 +1,135 @@
+package swnet
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+)
+
+var (
+	// ErrLineTooLong means no delimiter was found within the max length
+	ErrLineTooLong = errors.New("swnet: line too long")
+	// ErrInvalidPacketType means the packet to build is neither []byte nor string
+	ErrInvalidPacketType = errors.New("swnet: packet must be []byte or string")
+	// ErrEmptyDelimiter means the delimiter of DelimiterProtocol is empty
+	ErrEmptyDelimiter = errors.New("swnet: empty delimiter")
+)
+
+// DefaultMaxLineLength is used when the max length <= 0.
+const DefaultMaxLineLength = 64 * 1024
+
+// DelimiterProtocol is a PacketProtocol which splits frames on a delimiter.
+// The packet read is a []byte without the delimiter, and the packet to build
+// can be []byte or string, the delimiter is appended to it.
+//
+// DelimiterProtocol keeps a buffered reader, so the bytes after a delimiter
+// are not lost between ReadPacket calls. It implements ProtocolFactory, every
+// session gets its own copy.
+type DelimiterProtocol struct {
+	delim      []byte
+	writeDelim []byte
+	stripCR    bool
+	maxLength  int
+	conn       net.Conn
+	reader     *bufio.Reader
+}
+
+// NewDelimiterProtocol creates a DelimiterProtocol splitting on delim, a frame
+// longer than maxLength without the delimiter fails with ErrLineTooLong.
+func NewDelimiterProtocol(delim []byte, maxLength int) (*DelimiterProtocol, error) {
+	if len(delim) == 0 {
+		return nil, ErrEmptyDelimiter
+	}
+	if maxLength <= 0 {
+		maxLength = DefaultMaxLineLength
+	}
+	delim = append([]byte(nil), delim...)
+	return &DelimiterProtocol{
+		delim:      delim,
+		writeDelim: delim,
+		maxLength:  maxLength,
+	}, nil
+}
+
+// NewLineProtocol creates a DelimiterProtocol for text lines. Lines are split
+// on "\n" with an optional "\r" before it, and built with "\r\n".
+func NewLineProtocol(maxLength int) *DelimiterProtocol {
+	if maxLength <= 0 {
+		maxLength = DefaultMaxLineLength
+	}
+	return &DelimiterProtocol{
+		delim:      []byte("\n"),
+		writeDelim: []byte("\r\n"),
+		stripCR:    true,
+		maxLength:  maxLength,
+	}
+}
+
+// NewProtocol returns a copy of p without reader state.
+func (p *DelimiterProtocol) NewProtocol() PacketProtocol {
+	return &DelimiterProtocol{
+		delim:      p.delim,
+		writeDelim: p.writeDelim,
+		stripCR:    p.stripCR,
+		maxLength:  p.maxLength,
+	}
+}
+
+func (p *DelimiterProtocol) ReadPacket(conn net.Conn, buff []byte) (interface{}, []byte, error) {
+	if p.reader == nil || p.conn != conn {
+		p.conn = conn
+		p.reader = bufio.NewReader(conn)
+	}
+
+	last := p.delim[len(p.delim)-1]
+	limit := p.maxLength + len(p.delim)
+	if p.stripCR {
+		limit++
+	}
+	buff = buff[:0]
+	for {
+		line, err := p.reader.ReadSlice(last)
+		buff = append(buff, line...)
+		if err == nil && bytes.HasSuffix(buff, p.delim) {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, nil, err
+		}
+		if len(buff) > limit {
+			return nil, nil, ErrLineTooLong
+		}
+	}
+
+	line := buff[:len(buff)-len(p.delim)]
+	if p.stripCR && len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	if len(line) > p.maxLength {
+		return nil, nil, ErrLineTooLong
+	}
+	return append([]byte(nil), line...), buff, nil
+}
+
+func (p *DelimiterProtocol) BuildPacket(packet interface{}, buff []byte) ([]byte, error) {
+	switch v := packet.(type) {
+	case []byte:
+		buff = append(buff[:0], v...)
+	case string:
+		buff = append(buff[:0], v...)
+	default:
+		return nil, ErrInvalidPacketType
+	}
+	return append(buff, p.writeDelim...), nil
+}
+
+func (p *DelimiterProtocol) WritePacket(conn net.Conn, buff []byte) error {
+	_, err := conn.Write(buff)
+	return err
+}
+
+func (p *DelimiterProtocol) WritePackets(conn net.Conn, buffs net.Buffers) error {
+	_, err := buffs.WriteTo(conn)
+	return err
+}
@@ -0,0 +1,38 @@
+package swnet
+
+import (
+	"testing"
+)
+
+func TestNewDelimiterProtocolRejectsEmptyDelimiter(t *testing.T) {
+	for _, delim := range [][]byte{nil, {}} {
+		if p, err := NewDelimiterProtocol(delim, 0); err != ErrEmptyDelimiter || p != nil {
+			t.Fatalf("got %v, %v, want %v", p, err, ErrEmptyDelimiter)
+		}
+	}
+}
+
+func TestDelimiterProtocolKeepsBytesBetweenReads(t *testing.T) {
+	local, remote := newConnPair(t)
+	protocol, err := NewDelimiterProtocol([]byte("||"), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := make(chan string, 4)
+	s := NewSession(remote, protocol, func(_ *Session, packet interface{}) {
+		packets <- string(packet.([]byte))
+	}, 4)
+	s.Start()
+	defer s.Close()
+
+	for _, chunk := range []string{"one||tw", "o|", "|three||"} {
+		if _, err := local.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		if got := <-packets; got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
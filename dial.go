@@ -0,0 +1,108 @@
+package swnet
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// SocketOptions tunes the TCP socket of a session. Options are ignored if the
+// connection is not a TCP connection.
+type SocketOptions struct {
+	// KeepAlive is the period of TCP keepalive. Zero keeps the default,
+	// negative disables TCP keepalive.
+	KeepAlive time.Duration
+	// DisableNoDelay enables Nagle's algorithm, by default TCP_NODELAY is set.
+	DisableNoDelay bool
+	// ReadBuffer and WriteBuffer are the sizes of the socket buffers, zero keeps the default.
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+func (o *SocketOptions) apply(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if o.KeepAlive > 0 {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcpConn.SetKeepAlivePeriod(o.KeepAlive); err != nil {
+			return err
+		}
+	} else if o.KeepAlive < 0 {
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			return err
+		}
+	}
+	if o.DisableNoDelay {
+		if err := tcpConn.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DialOptions is the options of DialContext.
+type DialOptions struct {
+	SocketOptions
+	// Timeout is the max time to wait for the connection to complete, zero means no timeout.
+	Timeout time.Duration
+	// LocalAddr is the local address to bind, nil means a local address is chosen automatically.
+	LocalAddr net.Addr
+	// TLSConfig makes the connection encrypted by TLS if it is not nil.
+	TLSConfig *tls.Config
+}
+
+// DialContext is like Dial, but connects with options, and the connecting is
+// canceled if ctx is done before it completes.
+func DialContext(ctx context.Context, network, address string, options DialOptions,
+	protocol PacketProtocol, handler PacketHandler, sendChanSize int) (*Session, error) {
+	dialer := &net.Dialer{
+		Timeout:   options.Timeout,
+		LocalAddr: options.LocalAddr,
+		KeepAlive: options.KeepAlive,
+	}
+
+	var conn net.Conn
+	var err error
+	if options.TLSConfig != nil {
+		tlsDialer := &tls.Dialer{
+			NetDialer: dialer,
+			Config:    options.TLSConfig,
+		}
+		conn, err = tlsDialer.DialContext(ctx, network, address)
+	} else {
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = options.SocketOptions.apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return NewSession(conn, protocol, handler, sendChanSize), nil
+}
+
+// SetSocketOptions set the SocketOptions of accepted connections.
+func (s *Server) SetSocketOptions(options SocketOptions) {
+	s.socketOptions = options
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/eahydra/swnet"
 	"github.com/eahydra/swnet/example/protocol"
@@ -22,15 +24,23 @@ func main() {
 	swProtocol := protocol.NewDefaultProtocol(nil, false)
 	dispatcher := protocol.NewDispatcher()
 	dispatcher.AddHandler(protocol.PKTTYPE_KEEPALIVEACK, onKeepaliveAck)
-	session, err := swnet.Dial("tcp4", "127.0.0.1:19905", swProtocol, dispatcher.Handle, 1024)
+	options := swnet.DialOptions{
+		Timeout: 5 * time.Second,
+		SocketOptions: swnet.SocketOptions{
+			ReadBuffer:  64 * 1024,
+			WriteBuffer: 64 * 1024,
+		},
+	}
+	session, err := swnet.DialContext(context.Background(), "tcp4", "127.0.0.1:19905", options,
+		swProtocol, dispatcher.Handle, 1024)
 	if err != nil {
-		fmt.Println("swnet.Dial failed, err:", err)
+		fmt.Println("swnet.DialContext failed, err:", err)
 		return
 	}
 	defer session.Close()
 
-	session.SetCloseCallback(func(*swnet.Session) {
-		fmt.Println("exit")
+	session.SetCloseCallback(func(s *swnet.Session, err error) {
+		fmt.Println("exit, err:", err)
 		os.Exit(0)
 	})
 	session.Start()
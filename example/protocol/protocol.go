@@ -150,3 +150,8 @@ func (d *ProtocolImpl) WritePacket(conn net.Conn, buff []byte) error {
 	_, err := conn.Write(buff)
 	return err
 }
+
+func (d *ProtocolImpl) WritePackets(conn net.Conn, buffs net.Buffers) error {
+	_, err := buffs.WriteTo(conn)
+	return err
+}
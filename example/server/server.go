@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"net"
 
 	"github.com/eahydra/swnet"
 	"github.com/eahydra/swnet/example/protocol"
@@ -28,15 +27,15 @@ func main() {
 	}
 	defer server.Close()
 
+	server.SetSocketOptions(swnet.SocketOptions{
+		ReadBuffer:  64 * 1024,
+		WriteBuffer: 64 * 1024,
+	})
 	server.AcceptLoop(func(session *swnet.Session) {
-		tcpConn := session.RawConn().(*net.TCPConn)
-		fmt.Println("Incoming new session. Remote:", tcpConn.RemoteAddr().String())
-		tcpConn.SetNoDelay(true)
-		tcpConn.SetReadBuffer(64 * 1024)
-		tcpConn.SetWriteBuffer(64 * 1024)
+		fmt.Println("Incoming new session. Remote:", session.RawConn().RemoteAddr().String())
 
-		session.SetCloseCallback(func(s *swnet.Session) {
-			fmt.Println("session closed!")
+		session.SetCloseCallback(func(s *swnet.Session, err error) {
+			fmt.Println("session closed! err:", err)
 		})
 		session.Start()
 	})
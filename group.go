@@ -0,0 +1,110 @@
+package swnet
+
+import (
+	"sync"
+)
+
+// Group is a set of sessions, such as a room, that packets can be broadcast to.
+// A session leaves the group automatically when it closed.
+type Group struct {
+	writer  PacketWriter
+	rwlock  sync.RWMutex
+	members map[uint64]groupMember
+}
+
+type groupMember struct {
+	session *Session
+	hookID  uint64
+}
+
+// NewGroup creates an empty Group. writer is used by Broadcast to build packets,
+// so it should be compatible with the PacketProtocol of the members.
+func NewGroup(writer PacketWriter) *Group {
+	return &Group{
+		writer:  writer,
+		members: make(map[uint64]groupMember),
+	}
+}
+
+// Join adds session to the group. Join a closed session has no effect.
+func (g *Group) Join(session *Session) {
+	g.rwlock.Lock()
+	if _, ok := g.members[session.ID()]; ok {
+		g.rwlock.Unlock()
+		return
+	}
+	g.members[session.ID()] = groupMember{session: session}
+	g.rwlock.Unlock()
+
+	hookID := session.addCloseHook(func(session *Session, err error) {
+		g.rwlock.Lock()
+		delete(g.members, session.ID())
+		g.rwlock.Unlock()
+	})
+
+	g.rwlock.Lock()
+	if member, ok := g.members[session.ID()]; ok {
+		member.hookID = hookID
+		g.members[session.ID()] = member
+	}
+	g.rwlock.Unlock()
+}
+
+// Leave removes session from the group.
+func (g *Group) Leave(session *Session) {
+	g.rwlock.Lock()
+	member, ok := g.members[session.ID()]
+	delete(g.members, session.ID())
+	g.rwlock.Unlock()
+
+	if ok && member.hookID != 0 {
+		session.removeCloseHook(member.hookID)
+	}
+}
+
+// Len return how many sessions are in the group.
+func (g *Group) Len() int {
+	g.rwlock.RLock()
+	defer g.rwlock.RUnlock()
+	return len(g.members)
+}
+
+// Range calls fn for each session in the group. If fn returns false, stop the iteration.
+func (g *Group) Range(fn func(*Session) bool) {
+	for _, session := range g.sessions() {
+		if !fn(session) {
+			return
+		}
+	}
+}
+
+// Broadcast builds packet once and queues the built bytes to all sessions of the
+// group like AsyncSend. It returns the sessions failed to queue with their errors,
+// or the error of PacketWriter.BuildPacket.
+func (g *Group) Broadcast(packet interface{}) (map[*Session]error, error) {
+	buff, err := g.writer.BuildPacket(packet, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var failed map[*Session]error
+	for _, session := range g.sessions() {
+		if err := session.queue(sendRequest{packet: packet, built: buff, priority: PriorityNormal}); err != nil {
+			if failed == nil {
+				failed = make(map[*Session]error)
+			}
+			failed[session] = err
+		}
+	}
+	return failed, nil
+}
+
+func (g *Group) sessions() []*Session {
+	g.rwlock.RLock()
+	defer g.rwlock.RUnlock()
+	sessions := make([]*Session, 0, len(g.members))
+	for _, member := range g.members {
+		sessions = append(sessions, member.session)
+	}
+	return sessions
+}
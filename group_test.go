@@ -0,0 +1,36 @@
+package swnet
+
+import (
+	"bufio"
+	"reflect"
+	"testing"
+)
+
+func TestGroupBroadcastMixedWithBuildInBatch(t *testing.T) {
+	local, remote := newConnPair(t)
+	protocol := &batchProtocol{}
+	s := NewSession(local, protocol, nil, 16)
+	defer s.Close()
+
+	g := NewGroup(protocol)
+	g.Join(s)
+	// Queue everything before Start, so the packets are written in one batch.
+	for _, packet := range []string{"b1", "b2"} {
+		if failed, err := g.Broadcast(packet); err != nil || failed != nil {
+			t.Fatal(failed, err)
+		}
+	}
+	f := s.AsyncSendFuture("built")
+	s.Start()
+
+	lines := readLines(t, remote, bufio.NewReader(remote), 3)
+	if want := []string{"b1", "b2", "built"}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got %q, want %q", lines, want)
+	}
+	if err := f.Wait(testContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	if batches := protocol.Batches(); !reflect.DeepEqual(batches, []int{3}) {
+		t.Fatalf("batches %v", batches)
+	}
+}
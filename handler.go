@@ -0,0 +1,50 @@
+package swnet
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrorPacketHandler is a PacketHandler which can return an error.
+// If it returns an error, the session is closed with that error as the reason.
+type ErrorPacketHandler func(s *Session, packet interface{}) error
+
+// Handle adapts ErrorPacketHandler to PacketHandler.
+func (h ErrorPacketHandler) Handle(s *Session, packet interface{}) {
+	if err := h(s, packet); err != nil {
+		s.CloseWithError(err)
+	}
+}
+
+// PanicError is the error recovered from a panic of PacketHandler.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("swnet: packet handler panic: %v", e.Value)
+}
+
+// PanicHandler is invoked when PacketHandler panics while handling packet.
+// If it returns true, the session is closed with err as the reason.
+type PanicHandler func(s *Session, packet interface{}, err *PanicError) bool
+
+// SetPanicHandler can set a hook to report panics of PacketHandler. Without a hook,
+// the panic is recovered and the session is closed with a *PanicError.
+func (s *Session) SetPanicHandler(handler PanicHandler) {
+	s.panicHandler = handler
+}
+
+// handlePacket invokes PacketHandler and recovers the panic of it.
+func (s *Session) handlePacket(packet interface{}) {
+	defer func() {
+		if v := recover(); v != nil {
+			err := &PanicError{Value: v, Stack: debug.Stack()}
+			if s.panicHandler == nil || s.panicHandler(s, packet, err) {
+				s.CloseWithError(err)
+			}
+		}
+	}()
+	s.packetHandler(s, packet)
+}
@@ -0,0 +1,109 @@
+package swnet
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHeartbeatTimeout means the remote did not answer the pings of Heartbeat
+var ErrHeartbeatTimeout = errors.New("swnet: heartbeat timeout")
+
+// DefaultHeartbeatMaxMissed is used when Heartbeat.MaxMissed <= 0.
+const DefaultHeartbeatMaxMissed = 3
+
+// Heartbeat is an application heartbeat which can be attached to any Session by
+// Session.SetHeartbeat. It sends a ping every Interval, measures the round trip
+// time by the matched pong, and closes the session with ErrHeartbeatTimeout when
+// MaxMissed pings in a row are not answered. The remote must answer every ping
+// in order, a pong is matched to the oldest ping not answered yet.
+type Heartbeat struct {
+	// Interval between two pings.
+	Interval time.Duration
+	// MaxMissed is how many pings in a row can be unanswered.
+	MaxMissed int
+	// NewPing creates a ping packet. It is required.
+	NewPing func() interface{}
+	// IsPong reports whether the packet answers a ping. Pongs are consumed by
+	// the heartbeat and not passed to PacketHandler. It is required.
+	IsPong func(packet interface{}) bool
+	// IsPing and NewPong are optional. If both are set, pings from the remote are
+	// answered with NewPong automatically and not passed to PacketHandler.
+	IsPing  func(packet interface{}) bool
+	NewPong func(ping interface{}) interface{}
+}
+
+// SetHeartbeat attaches heartbeat to the session. It should be called before Start.
+// No ping is sent if Interval <= 0 or NewPing or IsPong is nil.
+func (s *Session) SetHeartbeat(heartbeat *Heartbeat) {
+	s.heartbeat = heartbeat
+}
+
+// RTT return the round trip time measured by the last pong of Heartbeat.
+// It returns zero if no pong has been received.
+func (s *Session) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+func (s *Session) heartbeatLoop() {
+	maxMissed := s.heartbeat.MaxMissed
+	if maxMissed <= 0 {
+		maxMissed = DefaultHeartbeatMaxMissed
+	}
+	ticker := time.NewTicker(s.heartbeat.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.heartbeatMu.Lock()
+			if s.missedPings >= maxMissed {
+				s.heartbeatMu.Unlock()
+				s.CloseWithError(ErrHeartbeatTimeout)
+				return
+			}
+			// Count the ping before queuing it, so a fast pong finds it.
+			s.missedPings++
+			s.pingsSentAt = append(s.pingsSentAt, time.Now())
+			s.heartbeatMu.Unlock()
+
+			if err := s.AsyncSendPriority(s.heartbeat.NewPing(), PriorityHigh); err != nil {
+				s.uncountPing()
+			}
+		case <-s.stopedChan:
+			return
+		}
+	}
+}
+
+// uncountPing takes back the last ping counted by heartbeatLoop, because it could
+// not be queued. A full chan of send says nothing about the remote.
+func (s *Session) uncountPing() {
+	s.heartbeatMu.Lock()
+	if s.missedPings > 0 {
+		s.missedPings--
+	}
+	if n := len(s.pingsSentAt); n > 0 {
+		s.pingsSentAt = s.pingsSentAt[:n-1]
+	}
+	s.heartbeatMu.Unlock()
+}
+
+// handleHeartbeat processes pings and pongs, returns true if packet was consumed.
+func (s *Session) handleHeartbeat(packet interface{}) bool {
+	if s.heartbeat.IsPong != nil && s.heartbeat.IsPong(packet) {
+		s.heartbeatMu.Lock()
+		s.missedPings = 0
+		if len(s.pingsSentAt) > 0 {
+			atomic.StoreInt64(&s.rtt, int64(time.Since(s.pingsSentAt[0])))
+			s.pingsSentAt = s.pingsSentAt[1:]
+		}
+		s.heartbeatMu.Unlock()
+		return true
+	}
+	if s.heartbeat.IsPing != nil && s.heartbeat.NewPong != nil && s.heartbeat.IsPing(packet) {
+		s.AsyncSendPriority(s.heartbeat.NewPong(packet), PriorityHigh)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package swnet
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// stalledProtocol blocks every write until release is closed.
+type stalledProtocol struct {
+	testProtocol
+	release chan struct{}
+}
+
+func (p *stalledProtocol) WritePacket(conn net.Conn, buff []byte) error {
+	<-p.release
+	return p.testProtocol.WritePacket(conn, buff)
+}
+
+func newTestHeartbeat() *Heartbeat {
+	return &Heartbeat{
+		Interval:  10 * time.Millisecond,
+		MaxMissed: 2,
+		NewPing:   func() interface{} { return "ping" },
+		IsPong:    func(packet interface{}) bool { return packet == "pong" },
+	}
+}
+
+func TestHeartbeatIgnoresPingsNotQueued(t *testing.T) {
+	local, _ := newConnPair(t)
+	protocol := &stalledProtocol{release: make(chan struct{})}
+	s := NewSession(local, protocol, nil, 1)
+	s.SetHeartbeat(newTestHeartbeat())
+	// sendLoop stalls on the first packet, the high lane is full after one ping.
+	s.AsyncSendPriority("control", PriorityHigh)
+	s.AsyncSend("data")
+	s.Start()
+	defer func() {
+		close(protocol.release)
+		s.Close()
+	}()
+
+	time.Sleep(20 * s.heartbeat.Interval)
+	if err := s.Err(); err != nil {
+		t.Fatalf("session closed by %v while no ping could be sent", err)
+	}
+}
+
+func TestHeartbeatWithoutIsPongNotStarted(t *testing.T) {
+	local, remote := newConnPair(t)
+	heartbeat := newTestHeartbeat()
+	heartbeat.IsPong = nil
+	s := NewSession(local, &testProtocol{}, nil, 4)
+	s.SetHeartbeat(heartbeat)
+	s.Start()
+	defer s.Close()
+
+	time.Sleep(20 * heartbeat.Interval)
+	if err := s.Err(); err != nil {
+		t.Fatalf("session closed by %v", err)
+	}
+	remote.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if n, _ := remote.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("ping sent without IsPong")
+	}
+}
+
+func TestHeartbeatRTTOfMatchedPing(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	local, remote := newConnPair(t)
+	heartbeat := newTestHeartbeat()
+	heartbeat.MaxMissed = 100
+	s := NewSession(local, &testProtocol{}, nil, 16)
+	s.SetHeartbeat(heartbeat)
+	s.Start()
+	defer s.Close()
+
+	// Every pong is late by more than one interval, so the next ping has
+	// been sent before the pong of the previous one arrives.
+	go func() {
+		r := bufio.NewReader(remote)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			time.Sleep(delay)
+			if _, err := remote.Write([]byte("pong\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(10 * delay)
+	if rtt := s.RTT(); rtt < delay {
+		t.Fatalf("RTT %v is less than the delay of pong %v", rtt, delay)
+	}
+}
@@ -0,0 +1,188 @@
+package swnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+var (
+	// ErrFrameTooLarge means the frame is larger than LengthFieldConfig.MaxFrameLength
+	ErrFrameTooLarge = errors.New("swnet: frame too large")
+	// ErrInvalidFrame means the length field of the frame is invalid
+	ErrInvalidFrame = errors.New("swnet: invalid frame length")
+	// ErrInvalidLengthField means LengthFieldConfig.LengthFieldLength is not 1, 2, 4 or 8
+	ErrInvalidLengthField = errors.New("swnet: length field must be 1, 2, 4 or 8 bytes")
+)
+
+// DefaultMaxFrameLength is used when LengthFieldConfig.MaxFrameLength <= 0.
+const DefaultMaxFrameLength = 1024 * 1024
+
+// BodyCodec marshals and unmarshals the body of a frame for LengthFieldProtocol.
+type BodyCodec interface {
+	// DecodeBody unmarshals a packet from body. body is only valid during the call.
+	DecodeBody(body []byte) (interface{}, error)
+	// EncodeBody appends the marshaled packet to buff and returns the extended buffer.
+	EncodeBody(packet interface{}, buff []byte) ([]byte, error)
+}
+
+// LengthFieldConfig describes the length field of frames, same as Netty's
+// LengthFieldBasedFrameDecoder.
+type LengthFieldConfig struct {
+	// LengthFieldOffset is how many bytes precede the length field in a frame.
+	LengthFieldOffset int
+	// LengthFieldLength is the size of the length field, 1, 2, 4 or 8.
+	LengthFieldLength int
+	// ByteOrder of the length field, nil means big endian.
+	ByteOrder binary.ByteOrder
+	// LengthAdjustment is added to the value of the length field to get how
+	// many bytes follow the length field.
+	LengthAdjustment int
+	// InitialBytesToStrip is how many bytes of a frame are skipped before
+	// passing it to BodyCodec.DecodeBody.
+	InitialBytesToStrip int
+	// MaxFrameLength is the max size of a frame including the header.
+	MaxFrameLength int
+}
+
+// LengthFieldProtocol is a PacketProtocol which frames packets with a length
+// field described by LengthFieldConfig, and marshals packets by BodyCodec.
+//
+// When reading, the whole frame is read, the first InitialBytesToStrip bytes are
+// skipped and the rest is passed to DecodeBody. If InitialBytesToStrip is less
+// than LengthFieldOffset+LengthFieldLength, DecodeBody also gets the length field.
+// When building, the output of EncodeBody must start with the LengthFieldOffset
+// bytes preceding the length field, the length field is inserted after them.
+// EncodeBody must not write the length field itself.
+type LengthFieldProtocol struct {
+	config LengthFieldConfig
+	codec  BodyCodec
+}
+
+// NewLengthFieldProtocol creates a LengthFieldProtocol.
+func NewLengthFieldProtocol(config LengthFieldConfig, codec BodyCodec) (*LengthFieldProtocol, error) {
+	switch config.LengthFieldLength {
+	case 1, 2, 4, 8:
+	default:
+		return nil, ErrInvalidLengthField
+	}
+	if config.LengthFieldOffset < 0 || config.InitialBytesToStrip < 0 {
+		return nil, ErrInvalidFrame
+	}
+	if config.ByteOrder == nil {
+		config.ByteOrder = binary.BigEndian
+	}
+	if config.MaxFrameLength <= 0 {
+		config.MaxFrameLength = DefaultMaxFrameLength
+	}
+	return &LengthFieldProtocol{
+		config: config,
+		codec:  codec,
+	}, nil
+}
+
+func (p *LengthFieldProtocol) headerLength() int {
+	return p.config.LengthFieldOffset + p.config.LengthFieldLength
+}
+
+func (p *LengthFieldProtocol) ReadPacket(conn net.Conn, buff []byte) (interface{}, []byte, error) {
+	headerLength := p.headerLength()
+	if cap(buff) < headerLength {
+		buff = make([]byte, headerLength)
+	}
+	if _, err := io.ReadFull(conn, buff[:headerLength]); err != nil {
+		return nil, nil, err
+	}
+
+	value := p.readLength(buff[p.config.LengthFieldOffset:headerLength])
+	if value > uint64(p.config.MaxFrameLength) {
+		return nil, nil, ErrFrameTooLarge
+	}
+	frameLength := int64(headerLength) + int64(value) + int64(p.config.LengthAdjustment)
+	if frameLength < int64(headerLength) || frameLength < int64(p.config.InitialBytesToStrip) {
+		return nil, nil, ErrInvalidFrame
+	}
+	if frameLength > int64(p.config.MaxFrameLength) {
+		return nil, nil, ErrFrameTooLarge
+	}
+
+	if cap(buff) < int(frameLength) {
+		frame := make([]byte, frameLength)
+		copy(frame, buff[:headerLength])
+		buff = frame
+	}
+	buff = buff[:frameLength]
+	if _, err := io.ReadFull(conn, buff[headerLength:]); err != nil {
+		return nil, nil, err
+	}
+
+	packet, err := p.codec.DecodeBody(buff[p.config.InitialBytesToStrip:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return packet, buff, nil
+}
+
+func (p *LengthFieldProtocol) BuildPacket(packet interface{}, buff []byte) ([]byte, error) {
+	offset := p.config.LengthFieldOffset
+	fieldLength := p.config.LengthFieldLength
+
+	// Reserve the length field at the beginning, then move the preceding bytes
+	// written by EncodeBody in front of it.
+	buff = append(buff[:0], make([]byte, fieldLength)...)
+	buff, err := p.codec.EncodeBody(packet, buff)
+	if err != nil {
+		return nil, err
+	}
+	if len(buff) < fieldLength+offset {
+		return nil, ErrInvalidFrame
+	}
+	if len(buff) > p.config.MaxFrameLength {
+		return nil, ErrFrameTooLarge
+	}
+	copy(buff[:offset], buff[fieldLength:fieldLength+offset])
+
+	value := int64(len(buff)-offset-fieldLength) - int64(p.config.LengthAdjustment)
+	if value < 0 || (fieldLength < 8 && value >= int64(1)<<(uint(fieldLength)*8)) {
+		return nil, ErrInvalidFrame
+	}
+	p.writeLength(buff[offset:offset+fieldLength], uint64(value))
+	return buff, nil
+}
+
+func (p *LengthFieldProtocol) WritePacket(conn net.Conn, buff []byte) error {
+	_, err := conn.Write(buff)
+	return err
+}
+
+func (p *LengthFieldProtocol) WritePackets(conn net.Conn, buffs net.Buffers) error {
+	_, err := buffs.WriteTo(conn)
+	return err
+}
+
+func (p *LengthFieldProtocol) readLength(b []byte) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(p.config.ByteOrder.Uint16(b))
+	case 4:
+		return uint64(p.config.ByteOrder.Uint32(b))
+	default:
+		return p.config.ByteOrder.Uint64(b)
+	}
+}
+
+func (p *LengthFieldProtocol) writeLength(b []byte, value uint64) {
+	switch len(b) {
+	case 1:
+		b[0] = byte(value)
+	case 2:
+		p.config.ByteOrder.PutUint16(b, uint16(value))
+	case 4:
+		p.config.ByteOrder.PutUint32(b, uint32(value))
+	default:
+		p.config.ByteOrder.PutUint64(b, value)
+	}
+}
@@ -0,0 +1,128 @@
+package swnet
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+type stringCodec struct{}
+
+func (stringCodec) DecodeBody(body []byte) (interface{}, error) {
+	return string(body), nil
+}
+
+func (stringCodec) EncodeBody(packet interface{}, buff []byte) ([]byte, error) {
+	return append(buff, packet.(string)...), nil
+}
+
+// readFrame reads one packet from frame by p.
+func readFrame(t *testing.T, p *LengthFieldProtocol, frame string) (interface{}, error) {
+	t.Helper()
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go remote.Write([]byte(frame))
+	packet, _, err := p.ReadPacket(local, nil)
+	return packet, err
+}
+
+func TestLengthFieldProtocolRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		config  LengthFieldConfig
+		packet  string
+		frame   string
+		decoded string
+	}{
+		{"2 bytes", LengthFieldConfig{LengthFieldLength: 2}, "hello", "\x00\x05hello", "\x00\x05hello"},
+		{"strip header", LengthFieldConfig{LengthFieldLength: 2, InitialBytesToStrip: 2}, "hello", "\x00\x05hello", "hello"},
+		{"little endian", LengthFieldConfig{LengthFieldLength: 4, ByteOrder: binary.LittleEndian, InitialBytesToStrip: 4},
+			"hi", "\x02\x00\x00\x00hi", "hi"},
+		{"offset", LengthFieldConfig{LengthFieldOffset: 1, LengthFieldLength: 1}, "Tbody", "T\x04body", "T\x04body"},
+		// The offset is longer than the length field, the bytes before it overlap when moved.
+		{"long offset", LengthFieldConfig{LengthFieldOffset: 3, LengthFieldLength: 2, InitialBytesToStrip: 5},
+			"ABCbody", "ABC\x00\x04body", "body"},
+		{"8 bytes whole frame", LengthFieldConfig{LengthFieldLength: 8, LengthAdjustment: -8, InitialBytesToStrip: 8},
+			"body", "\x00\x00\x00\x00\x00\x00\x00\x0cbody", "body"},
+		{"trailer not counted", LengthFieldConfig{LengthFieldLength: 2, LengthAdjustment: 2, InitialBytesToStrip: 2},
+			"body!!", "\x00\x04body!!", "body!!"},
+	} {
+		p, err := NewLengthFieldProtocol(c.config, stringCodec{})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		frame, err := p.BuildPacket(c.packet, make([]byte, 3))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if string(frame) != c.frame {
+			t.Fatalf("%s: built %q, want %q", c.name, frame, c.frame)
+		}
+		decoded, err := readFrame(t, p, c.frame)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if decoded != c.decoded {
+			t.Fatalf("%s: decoded %q, want %q", c.name, decoded, c.decoded)
+		}
+	}
+}
+
+func TestLengthFieldProtocolRejects(t *testing.T) {
+	for _, config := range []LengthFieldConfig{{LengthFieldLength: 0}, {LengthFieldLength: 3}} {
+		if _, err := NewLengthFieldProtocol(config, stringCodec{}); err != ErrInvalidLengthField {
+			t.Fatalf("%+v: got %v, want %v", config, err, ErrInvalidLengthField)
+		}
+	}
+	for _, config := range []LengthFieldConfig{
+		{LengthFieldLength: 2, LengthFieldOffset: -1},
+		{LengthFieldLength: 2, InitialBytesToStrip: -1},
+	} {
+		if _, err := NewLengthFieldProtocol(config, stringCodec{}); err != ErrInvalidFrame {
+			t.Fatalf("%+v: got %v, want %v", config, err, ErrInvalidFrame)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		config LengthFieldConfig
+		packet string
+		err    error
+	}{
+		{"larger than max", LengthFieldConfig{LengthFieldLength: 2, MaxFrameLength: 8}, "0123456789", ErrFrameTooLarge},
+		{"overflows field", LengthFieldConfig{LengthFieldLength: 1}, strings.Repeat("x", 256), ErrInvalidFrame},
+		{"negative length", LengthFieldConfig{LengthFieldLength: 2, LengthAdjustment: 10}, "body", ErrInvalidFrame},
+		{"shorter than offset", LengthFieldConfig{LengthFieldOffset: 3, LengthFieldLength: 2}, "AB", ErrInvalidFrame},
+	} {
+		p, err := NewLengthFieldProtocol(c.config, stringCodec{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.BuildPacket(c.packet, nil); err != c.err {
+			t.Fatalf("build %s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		config LengthFieldConfig
+		frame  string
+		err    error
+	}{
+		{"larger than max", LengthFieldConfig{LengthFieldLength: 2, MaxFrameLength: 100}, "\xff\xff", ErrFrameTooLarge},
+		{"header counted over max", LengthFieldConfig{LengthFieldLength: 2, MaxFrameLength: 100}, "\x00\x63", ErrFrameTooLarge},
+		{"8 bytes huge", LengthFieldConfig{LengthFieldLength: 8}, "\x80\x00\x00\x00\x00\x00\x00\x00", ErrFrameTooLarge},
+		{"negative length", LengthFieldConfig{LengthFieldLength: 2, LengthAdjustment: -8}, "\x00\x02", ErrInvalidFrame},
+		{"shorter than strip", LengthFieldConfig{LengthFieldLength: 2, InitialBytesToStrip: 10}, "\x00\x01a", ErrInvalidFrame},
+	} {
+		p, err := NewLengthFieldProtocol(c.config, stringCodec{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readFrame(t, p, c.frame); err != c.err {
+			t.Fatalf("read %s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package swnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var (
+	// ErrStreamReset means the stream was reset by Stream.Reset or by the remote
+	ErrStreamReset = errors.New("swnet: stream reset")
+	// ErrStreamClosed means the stream had been closed for writing
+	ErrStreamClosed = errors.New("swnet: stream closed")
+	// ErrMuxFrame means a packet which is not *MuxFrame was passed to Mux
+	ErrMuxFrame = errors.New("swnet: invalid mux frame")
+)
+
+const (
+	// MuxWindowSize is the initial flow-control window of every stream in bytes.
+	MuxWindowSize = 256 * 1024
+	// MaxMuxFrameData is the max size of data carried by one MuxFrame.
+	MaxMuxFrameData = 16 * 1024
+	// MuxAcceptBacklog is how many opened streams can wait for Mux.Accept.
+	// If the backlog is full, new streams are reset.
+	MuxAcceptBacklog = 256
+
+	muxHeaderSize = 9
+)
+
+// MuxFrameType is the type of MuxFrame.
+type MuxFrameType uint8
+
+const (
+	// MuxOpen opens a stream.
+	MuxOpen MuxFrameType = iota
+	// MuxData carries the data of a stream.
+	MuxData
+	// MuxWindowUpdate grants the remote Window more bytes to send.
+	MuxWindowUpdate
+	// MuxClose closes the sending side of a stream.
+	MuxClose
+	// MuxReset aborts a stream.
+	MuxReset
+)
+
+// MuxFrame is the packet exchanged by Mux.
+type MuxFrame struct {
+	Type     MuxFrameType
+	StreamID uint32
+	Window   uint32
+	Data     []byte
+}
+
+// MuxProtocol is a PacketProtocol for *MuxFrame. A frame is a 9 bytes header,
+// type(1) stream id(4) length or window(4) in big endian, followed by the data.
+type MuxProtocol struct{}
+
+func (MuxProtocol) ReadPacket(conn net.Conn, buff []byte) (interface{}, []byte, error) {
+	if cap(buff) < muxHeaderSize {
+		buff = make([]byte, muxHeaderSize)
+	}
+	header := buff[:muxHeaderSize]
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, nil, err
+	}
+	frame := &MuxFrame{
+		Type:     MuxFrameType(header[0]),
+		StreamID: binary.BigEndian.Uint32(header[1:5]),
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if frame.Type != MuxData {
+		frame.Window = length
+		return frame, buff, nil
+	}
+	if length > MaxMuxFrameData {
+		return nil, nil, ErrMuxFrame
+	}
+	frame.Data = make([]byte, length)
+	if _, err := io.ReadFull(conn, frame.Data); err != nil {
+		return nil, nil, err
+	}
+	return frame, buff, nil
+}
+
+func (MuxProtocol) BuildPacket(packet interface{}, buff []byte) ([]byte, error) {
+	frame, ok := packet.(*MuxFrame)
+	if !ok {
+		return nil, ErrMuxFrame
+	}
+	length := frame.Window
+	if frame.Type == MuxData {
+		length = uint32(len(frame.Data))
+	}
+	buff = append(buff[:0], byte(frame.Type), 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buff[1:5], frame.StreamID)
+	binary.BigEndian.PutUint32(buff[5:9], length)
+	return append(buff, frame.Data...), nil
+}
+
+func (MuxProtocol) WritePacket(conn net.Conn, buff []byte) error {
+	_, err := conn.Write(buff)
+	return err
+}
+
+func (MuxProtocol) WritePackets(conn net.Conn, buffs net.Buffers) error {
+	_, err := buffs.WriteTo(conn)
+	return err
+}
+
+// Mux multiplexes independent streams over one Session. The session must use a
+// PacketProtocol for *MuxFrame, such as MuxProtocol. Every stream has its own
+// flow-control window, so a stream not being read doesn't block the others.
+type Mux struct {
+	session    *Session
+	rwlock     sync.RWMutex
+	streams    map[uint32]*Stream
+	nextID     uint32
+	acceptChan chan *Stream
+	resetChan  chan uint32
+	doneChan   chan struct{}
+}
+
+// NewMux creates a Mux on session and takes over its PacketHandler, so it should
+// be called before Session.Start. The two sides of the session must pass different
+// client values, so the IDs of the streams they open don't conflict.
+func NewMux(session *Session, client bool) *Mux {
+	m := &Mux{
+		session:    session,
+		streams:    make(map[uint32]*Stream),
+		nextID:     2,
+		acceptChan: make(chan *Stream, MuxAcceptBacklog),
+		resetChan:  make(chan uint32, MuxAcceptBacklog),
+		doneChan:   make(chan struct{}),
+	}
+	if client {
+		m.nextID = 1
+	}
+	session.SetPacketHandler(m.handle)
+	session.addCloseHook(m.stop)
+	go m.resetLoop()
+	return m
+}
+
+// Session return the session of the mux.
+func (m *Mux) Session() *Session {
+	return m.session
+}
+
+// Open opens a new stream.
+func (m *Mux) Open() (*Stream, error) {
+	m.rwlock.Lock()
+	select {
+	case <-m.doneChan:
+		m.rwlock.Unlock()
+		return nil, m.session.Err()
+	default:
+	}
+	stream := newStream(m, m.nextID)
+	m.nextID += 2
+	m.streams[stream.id] = stream
+	m.rwlock.Unlock()
+
+	if err := m.send(&MuxFrame{Type: MuxOpen, StreamID: stream.id}); err != nil {
+		m.remove(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for a stream opened by the remote.
+// If the session closed, return the reason why the session closed.
+func (m *Mux) Accept() (*Stream, error) {
+	select {
+	case stream := <-m.acceptChan:
+		return stream, nil
+	case <-m.doneChan:
+		return nil, m.session.Err()
+	}
+}
+
+// Close closes the session of the mux, all streams are reset.
+func (m *Mux) Close() error {
+	return m.session.Close()
+}
+
+func (m *Mux) send(frame *MuxFrame) error {
+	return m.session.Send(context.Background(), frame)
+}
+
+// sendControl sends frames which don't need to keep order with data. It waits
+// for free space instead of failing, a lost window update stalls the stream.
+// It must not be called by handle, the remote may be waiting for us to read.
+func (m *Mux) sendControl(frame *MuxFrame) error {
+	return m.session.SendPriority(context.Background(), frame, PriorityHigh)
+}
+
+// resetLater queues a reset of stream id to resetLoop, because handle can't wait
+// for free space of the chan of send. Return false if too many resets are pending.
+func (m *Mux) resetLater(id uint32) bool {
+	select {
+	case m.resetChan <- id:
+		return true
+	default:
+		return false
+	}
+}
+
+// resetLoop sends the resets queued by handle. Resets keep order with the Open
+// and Data frames, so the remote never sees a reset before the stream opened.
+func (m *Mux) resetLoop() {
+	for {
+		select {
+		case id := <-m.resetChan:
+			if m.send(&MuxFrame{Type: MuxReset, StreamID: id}) != nil {
+				return
+			}
+		case <-m.doneChan:
+			return
+		}
+	}
+}
+
+func (m *Mux) remove(id uint32) {
+	m.rwlock.Lock()
+	delete(m.streams, id)
+	m.rwlock.Unlock()
+}
+
+func (m *Mux) handle(s *Session, packet interface{}) {
+	frame, ok := packet.(*MuxFrame)
+	if !ok {
+		s.CloseWithError(ErrMuxFrame)
+		return
+	}
+
+	m.rwlock.Lock()
+	stream, ok := m.streams[frame.StreamID]
+	if frame.Type == MuxOpen {
+		if ok {
+			m.rwlock.Unlock()
+			s.CloseWithError(ErrMuxFrame)
+			return
+		}
+		stream = newStream(m, frame.StreamID)
+		m.streams[stream.id] = stream
+	}
+	m.rwlock.Unlock()
+
+	if frame.Type == MuxOpen {
+		select {
+		case m.acceptChan <- stream:
+		default:
+			stream.abort()
+		}
+		return
+	}
+	if !ok {
+		// The reset is lost if too many are pending, the next Data frame
+		// of the stream triggers another one.
+		if frame.Type == MuxData {
+			m.resetLater(frame.StreamID)
+		}
+		return
+	}
+
+	switch frame.Type {
+	case MuxData:
+		if !stream.push(frame.Data) {
+			stream.abort()
+		}
+	case MuxWindowUpdate:
+		stream.grant(frame.Window)
+	case MuxClose:
+		stream.remoteClose()
+	case MuxReset:
+		stream.reset(ErrStreamReset)
+		m.remove(stream.id)
+	}
+}
+
+// stop resets all streams when the session closed.
+func (m *Mux) stop(s *Session, err error) {
+	m.rwlock.Lock()
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	close(m.doneChan)
+	m.rwlock.Unlock()
+
+	for _, stream := range streams {
+		stream.reset(err)
+	}
+}
+
+// Stream is a logical stream of Mux with io.ReadWriteCloser semantics.
+type Stream struct {
+	id         uint32
+	mux        *Mux
+	mu         sync.Mutex
+	recvBuff   bytes.Buffer
+	recvWindow uint32
+	consumed   uint32
+	sendWindow uint32
+	readChan   chan struct{}
+	writeChan  chan struct{}
+	localDone  bool
+	remoteDone bool
+	err        error
+}
+
+func newStream(m *Mux, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		mux:        m,
+		recvWindow: MuxWindowSize,
+		sendWindow: MuxWindowSize,
+		readChan:   make(chan struct{}, 1),
+		writeChan:  make(chan struct{}, 1),
+	}
+}
+
+// ID return the id of the stream.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads the data of the stream. It returns io.EOF after the remote closed
+// the stream and all data had been read.
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuff.Len() > 0 {
+			n, _ := st.recvBuff.Read(p)
+			st.consumed += uint32(n)
+			var update uint32
+			if st.consumed >= MuxWindowSize/2 && !st.remoteDone {
+				update = st.consumed
+				st.recvWindow += update
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				st.mux.sendControl(&MuxFrame{Type: MuxWindowUpdate, StreamID: st.id, Window: update})
+			}
+			return n, nil
+		}
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+		if st.remoteDone {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		st.mu.Unlock()
+		<-st.readChan
+	}
+}
+
+// Write writes p to the stream. It waits when the window of the remote is exhausted.
+func (st *Stream) Write(p []byte) (int, error) {
+	var written int
+	for written < len(p) {
+		st.mu.Lock()
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		}
+		if st.localDone {
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			st.mu.Unlock()
+			<-st.writeChan
+			continue
+		}
+		n := len(p) - written
+		if n > MaxMuxFrameData {
+			n = MaxMuxFrameData
+		}
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		data := make([]byte, n)
+		copy(data, p[written:])
+		if err := st.mux.send(&MuxFrame{Type: MuxData, StreamID: st.id, Data: data}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close closes the sending side of the stream, the remote reads io.EOF after
+// the written data. The stream can still be read until the remote closes it.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localDone || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localDone = true
+	done := st.remoteDone
+	st.mu.Unlock()
+
+	if done {
+		st.mux.remove(st.id)
+	}
+	return st.mux.send(&MuxFrame{Type: MuxClose, StreamID: st.id})
+}
+
+// Reset aborts the stream in both directions, the pending Read and Write of
+// both sides return ErrStreamReset.
+func (st *Stream) Reset() error {
+	st.reset(ErrStreamReset)
+	st.mux.remove(st.id)
+	return st.mux.send(&MuxFrame{Type: MuxReset, StreamID: st.id})
+}
+
+// abort is Reset called by Mux.handle, the reset is sent by resetLoop.
+// If the remote doesn't read the pending resets, the session is closed as
+// a slow consumer, so the stream is not left open on the remote.
+func (st *Stream) abort() {
+	st.reset(ErrStreamReset)
+	st.mux.remove(st.id)
+	if !st.mux.resetLater(st.id) {
+		st.mux.session.CloseWithError(ErrSlowConsumer)
+	}
+}
+
+// push appends the data received, return false if the remote exceeded the window.
+func (st *Stream) push(data []byte) bool {
+	st.mu.Lock()
+	if uint32(len(data)) > st.recvWindow {
+		st.mu.Unlock()
+		return false
+	}
+	st.recvWindow -= uint32(len(data))
+	st.recvBuff.Write(data)
+	st.mu.Unlock()
+	notify(st.readChan)
+	return true
+}
+
+func (st *Stream) grant(window uint32) {
+	st.mu.Lock()
+	st.sendWindow += window
+	st.mu.Unlock()
+	notify(st.writeChan)
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteDone = true
+	done := st.localDone
+	st.mu.Unlock()
+	notify(st.readChan)
+	if done {
+		st.mux.remove(st.id)
+	}
+}
+
+func (st *Stream) reset(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	notify(st.readChan)
+	notify(st.writeChan)
+}
+
+// notify wakes up the waiter of ch without blocking.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,162 @@
+package swnet
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowMuxProtocol delays every write, so the send queue of the session fills up.
+type slowMuxProtocol struct {
+	MuxProtocol
+}
+
+func (p slowMuxProtocol) WritePacket(conn net.Conn, buff []byte) error {
+	time.Sleep(50 * time.Microsecond)
+	return p.MuxProtocol.WritePacket(conn, buff)
+}
+
+func (p slowMuxProtocol) WritePackets(conn net.Conn, buffs net.Buffers) error {
+	time.Sleep(50 * time.Microsecond)
+	return p.MuxProtocol.WritePackets(conn, buffs)
+}
+
+func newMuxPair(t *testing.T, protocol PacketProtocol, sendChanSize int) (*Mux, *Mux) {
+	local, remote := newConnPair(t)
+	client := NewMux(NewSession(local, protocol, nil, sendChanSize), true)
+	server := NewMux(NewSession(remote, protocol, nil, sendChanSize), false)
+	client.Session().Start()
+	server.Session().Start()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestMuxFlowControlWithSaturatedSendQueue(t *testing.T) {
+	const streams = 8
+	const size = 3 * MuxWindowSize
+
+	// With one slot per lane, window updates compete with data frames for the
+	// queue, they must never be dropped or the streams stall.
+	client, server := newMuxPair(t, slowMuxProtocol{}, 1)
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*streams)
+	for _, m := range []*Mux{client, server} {
+		m := m
+		for i := 0; i < streams; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				stream, err := m.Open()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err := stream.Write(data); err != nil {
+					errs <- err
+					return
+				}
+				errs <- stream.Close()
+			}()
+			go func() {
+				defer wg.Done()
+				stream, err := m.Accept()
+				if err != nil {
+					errs <- err
+					return
+				}
+				got, err := io.ReadAll(stream)
+				if err == nil && !bytes.Equal(got, data) {
+					err = io.ErrUnexpectedEOF
+				}
+				errs <- err
+			}()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("streams stalled")
+	}
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMuxResetReachesRemote(t *testing.T) {
+	client, server := newMuxPair(t, slowMuxProtocol{}, 1)
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("got %v, want %v", err, ErrStreamReset)
+	}
+}
+
+func TestMuxResetAfterOpenWhileSendQueueBusy(t *testing.T) {
+	client, server := newMuxPair(t, slowMuxProtocol{}, 1)
+
+	// Keep the normal lane busy with a bulk stream.
+	bulk, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteBulk, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, remoteBulk)
+	go bulk.Write(bytes.Repeat([]byte("x"), 4*MuxWindowSize))
+
+	for i := 0; i < 20; i++ {
+		stream, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		remote, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := make(chan error, 1)
+		go func() {
+			_, err := remote.Read(make([]byte, 1))
+			result <- err
+		}()
+		select {
+		case err := <-result:
+			if err != ErrStreamReset {
+				t.Fatalf("got %v, want %v", err, ErrStreamReset)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("reset overtook open, the accepted stream is never reset")
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package swnet
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoSession means the pool has no live session to select
+var ErrNoSession = errors.New("swnet: no live session in pool")
+
+// PoolStrategy decides how Pool.Get selects a session.
+type PoolStrategy int
+
+const (
+	// PoolRoundRobin selects the live sessions in turn.
+	PoolRoundRobin PoolStrategy = iota
+	// PoolLeastQueued selects the session with the fewest packets in its send queue.
+	PoolLeastQueued
+	// PoolConsistentHash selects the address by the key on a consistent hash ring,
+	// so the same key goes to the same address while it is alive.
+	PoolConsistentHash
+)
+
+// poolReplicas is the count of virtual nodes of every address on the hash ring.
+const poolReplicas = 160
+
+// Pool maintains sessions to several backend addresses. Closed sessions are
+// evicted and replaced by redialing with backoff.
+type Pool struct {
+	addrs    []string
+	size     int
+	strategy PoolStrategy
+	dial     func(ctx context.Context, address string) (*Session, error)
+	ring     []poolNode
+	next     uint64
+
+	rwlock     sync.RWMutex
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	sessions   map[string][]*Session
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+type poolNode struct {
+	hash    uint32
+	address string
+}
+
+// NewPool creates a Pool which keeps size sessions to every address of addrs.
+// dial creates a session to address, such as by DialContext, and the pool starts it.
+// The sessions are dialed in background, so Get may return ErrNoSession at first.
+func NewPool(addrs []string, size int, strategy PoolStrategy,
+	dial func(ctx context.Context, address string) (*Session, error)) *Pool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		addrs:      addrs,
+		size:       size,
+		strategy:   strategy,
+		dial:       dial,
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+		sessions:   make(map[string][]*Session),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	for _, address := range addrs {
+		for i := 0; i < poolReplicas; i++ {
+			p.ring = append(p.ring, poolNode{
+				hash:    crc32.ChecksumIEEE([]byte(address + "#" + strconv.Itoa(i))),
+				address: address,
+			})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+
+	for _, address := range addrs {
+		for i := 0; i < size; i++ {
+			p.wg.Add(1)
+			go p.keep(address)
+		}
+	}
+	return p
+}
+
+// SetBackoff set the min and max delay between redials, it takes effect from the next redial.
+func (p *Pool) SetBackoff(min, max time.Duration) {
+	p.rwlock.Lock()
+	p.minBackoff = min
+	p.maxBackoff = max
+	p.rwlock.Unlock()
+}
+
+// Get selects a live session by the strategy of the pool.
+// key is only used by PoolConsistentHash.
+func (p *Pool) Get(key string) (*Session, error) {
+	p.rwlock.RLock()
+	defer p.rwlock.RUnlock()
+
+	switch p.strategy {
+	case PoolLeastQueued:
+		var selected *Session
+		for _, sessions := range p.sessions {
+			for _, session := range sessions {
+				if selected == nil || session.GetSendQueueLen() < selected.GetSendQueueLen() {
+					selected = session
+				}
+			}
+		}
+		if selected == nil {
+			return nil, ErrNoSession
+		}
+		return selected, nil
+	case PoolConsistentHash:
+		if len(p.ring) == 0 {
+			return nil, ErrNoSession
+		}
+		hash := crc32.ChecksumIEEE([]byte(key))
+		start := sort.Search(len(p.ring), func(i int) bool {
+			return p.ring[i].hash >= hash
+		})
+		for i := 0; i < len(p.ring); i++ {
+			sessions := p.sessions[p.ring[(start+i)%len(p.ring)].address]
+			if len(sessions) > 0 {
+				return sessions[atomic.AddUint64(&p.next, 1)%uint64(len(sessions))], nil
+			}
+		}
+		return nil, ErrNoSession
+	default:
+		var count int
+		for _, sessions := range p.sessions {
+			count += len(sessions)
+		}
+		if count == 0 {
+			return nil, ErrNoSession
+		}
+		n := int(atomic.AddUint64(&p.next, 1) % uint64(count))
+		for _, address := range p.addrs {
+			if n < len(p.sessions[address]) {
+				return p.sessions[address][n], nil
+			}
+			n -= len(p.sessions[address])
+		}
+		return nil, ErrNoSession
+	}
+}
+
+// Count return how many live sessions the pool has.
+func (p *Pool) Count() int {
+	p.rwlock.RLock()
+	defer p.rwlock.RUnlock()
+	var count int
+	for _, sessions := range p.sessions {
+		count += len(sessions)
+	}
+	return count
+}
+
+// Close stops redialing and closes all sessions of the pool.
+func (p *Pool) Close() error {
+	p.cancel()
+	p.rwlock.RLock()
+	var sessions []*Session
+	for _, list := range p.sessions {
+		sessions = append(sessions, list...)
+	}
+	p.rwlock.RUnlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+	p.wg.Wait()
+	return nil
+}
+
+// keep maintains one session to address until the pool closed.
+func (p *Pool) keep(address string) {
+	defer p.wg.Done()
+
+	for attempt := 0; ; {
+		session, err := p.dial(p.ctx, address)
+		if err != nil {
+			if !p.sleep(p.backoff(attempt)) {
+				return
+			}
+			attempt++
+			continue
+		}
+		connectedAt := time.Now()
+
+		stopedChan := make(chan struct{})
+		session.addCloseHook(func(*Session, error) {
+			close(stopedChan)
+		})
+		session.Start()
+		if !p.add(address, session) {
+			session.Close()
+			return
+		}
+
+		<-stopedChan
+		p.remove(address, session)
+		if time.Since(connectedAt) >= StableSessionDuration {
+			attempt = 0
+		}
+		if !p.sleep(p.backoff(attempt)) {
+			return
+		}
+		attempt++
+	}
+}
+
+// add puts session into the pool, return false if the pool closed.
+func (p *Pool) add(address string, session *Session) bool {
+	p.rwlock.Lock()
+	defer p.rwlock.Unlock()
+	if p.ctx.Err() != nil {
+		return false
+	}
+	p.sessions[address] = append(p.sessions[address], session)
+	return true
+}
+
+func (p *Pool) remove(address string, session *Session) {
+	p.rwlock.Lock()
+	defer p.rwlock.Unlock()
+	sessions := p.sessions[address]
+	for i := range sessions {
+		if sessions[i] == session {
+			p.sessions[address] = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+}
+
+// backoff return the jittered delay before the next redial.
+func (p *Pool) backoff(attempt int) time.Duration {
+	p.rwlock.RLock()
+	defer p.rwlock.RUnlock()
+	return jitteredBackoff(p.minBackoff, p.maxBackoff, attempt)
+}
+
+// sleep waits for d, return false if the pool closed before that.
+func (p *Pool) sleep(d time.Duration) bool {
+	return sleepUntil(p.ctx.Done(), d)
+}
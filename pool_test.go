@@ -0,0 +1,275 @@
+package swnet
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBackend accepts connections and discards what they send.
+type testBackend struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+func newTestBackend(t *testing.T) *testBackend {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBackend{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, conn)
+			b.mu.Unlock()
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	t.Cleanup(b.close)
+	return b
+}
+
+func (b *testBackend) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// dropConns closes the accepted connections, but keeps listening.
+func (b *testBackend) dropConns() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+func (b *testBackend) close() {
+	b.listener.Close()
+	b.dropConns()
+}
+
+func dialTestSession(ctx context.Context, address string) (*Session, error) {
+	return DialContext(ctx, "tcp", address, DialOptions{}, &testProtocol{}, nil, 16)
+}
+
+// waitPoolEvicted waits until the pool has n live sessions and none of evicted.
+func waitPoolEvicted(t *testing.T, p *Pool, n int, evicted ...*Session) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		found := false
+		p.rwlock.RLock()
+		for _, sessions := range p.sessions {
+			for _, s := range sessions {
+				for _, e := range evicted {
+					found = found || s == e
+				}
+			}
+		}
+		p.rwlock.RUnlock()
+		if !found && p.Count() == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d sessions, want %d without the closed ones", p.Count(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitPoolCount waits until the pool has n live sessions.
+func waitPoolCount(t *testing.T, p *Pool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Count() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d sessions, want %d", p.Count(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func sessionAddr(s *Session) string {
+	return s.RawConn().RemoteAddr().String()
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	backends := []*testBackend{newTestBackend(t), newTestBackend(t)}
+	p := NewPool([]string{backends[0].Addr(), backends[1].Addr()}, 2, PoolRoundRobin, dialTestSession)
+	defer p.Close()
+	waitPoolCount(t, p, 4)
+
+	// Every session is selected once in 4 calls, and again in the next 4.
+	for round := 0; round < 2; round++ {
+		seen := make(map[*Session]bool)
+		for i := 0; i < 4; i++ {
+			s, err := p.Get("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen[s] = true
+		}
+		if len(seen) != 4 {
+			t.Fatalf("round %d selected %d different sessions, want 4", round, len(seen))
+		}
+	}
+}
+
+func TestPoolLeastQueued(t *testing.T) {
+	busy, idle := newTestBackend(t), newTestBackend(t)
+	release := make(chan struct{})
+	defer close(release)
+	p := NewPool([]string{busy.Addr(), idle.Addr()}, 1, PoolLeastQueued,
+		func(ctx context.Context, address string) (*Session, error) {
+			if address != busy.Addr() {
+				return dialTestSession(ctx, address)
+			}
+			// The writes of this session stall, so its queue grows.
+			return DialContext(ctx, "tcp", address, DialOptions{},
+				&stalledProtocol{release: release}, nil, 16)
+		})
+	defer p.Close()
+	waitPoolCount(t, p, 2)
+
+	// While both queues are empty either session can be selected.
+	var busySession *Session
+	for i := 0; i < 100 && busySession == nil; i++ {
+		s, err := p.Get("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessionAddr(s) == busy.Addr() {
+			busySession = s
+		}
+	}
+	if busySession == nil {
+		t.Fatal("the session of busy backend never selected")
+	}
+	for i := 0; i < 3; i++ {
+		busySession.AsyncSend("x")
+	}
+	for i := 0; i < 10; i++ {
+		s, err := p.Get("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessionAddr(s) != idle.Addr() {
+			t.Fatalf("selected the session with %d queued packets", s.GetSendQueueLen())
+		}
+	}
+}
+
+func TestPoolConsistentHash(t *testing.T) {
+	backends := []*testBackend{newTestBackend(t), newTestBackend(t), newTestBackend(t)}
+	addrs := []string{backends[0].Addr(), backends[1].Addr(), backends[2].Addr()}
+	p := NewPool(addrs, 1, PoolConsistentHash, dialTestSession)
+	defer p.Close()
+	p.SetBackoff(time.Hour, time.Hour)
+	waitPoolCount(t, p, 3)
+
+	keys := make(map[string]string)
+	used := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		s, err := p.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[key] = sessionAddr(s)
+		used[keys[key]] = true
+		if again, _ := p.Get(key); sessionAddr(again) != keys[key] {
+			t.Fatalf("key %s moved without a change of sessions", key)
+		}
+	}
+	if len(used) != len(addrs) {
+		t.Fatalf("100 keys used %d of %d addresses", len(used), len(addrs))
+	}
+
+	// After one address is gone, only its keys move.
+	backends[0].close()
+	waitPoolCount(t, p, 2)
+	for key, address := range keys {
+		s, err := p.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sessionAddr(s); got == addrs[0] || (address != addrs[0] && got != address) {
+			t.Fatalf("key %s moved from %s to %s", key, address, got)
+		}
+	}
+}
+
+func TestPoolReplacesClosedSessions(t *testing.T) {
+	backend := newTestBackend(t)
+	p := NewPool([]string{backend.Addr()}, 2, PoolRoundRobin, dialTestSession)
+	defer p.Close()
+	p.SetBackoff(time.Millisecond, 10*time.Millisecond)
+	waitPoolCount(t, p, 2)
+
+	old, err := p.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+	waitPoolEvicted(t, p, 2, old)
+
+	// Sessions closed by the remote are replaced too.
+	first, _ := p.Get("")
+	second, _ := p.Get("")
+	backend.dropConns()
+	waitPoolEvicted(t, p, 2, first, second)
+	p.Close()
+	if p.Count() != 0 {
+		t.Fatalf("%d sessions after Close", p.Count())
+	}
+	if _, err := p.Get(""); err != ErrNoSession {
+		t.Fatalf("got %v, want %v", err, ErrNoSession)
+	}
+}
+
+func TestPoolBacksOffUnstableSessions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	var mu sync.Mutex
+	dials := 0
+	p := NewPool([]string{listener.Addr().String()}, 1, PoolRoundRobin,
+		func(ctx context.Context, address string) (*Session, error) {
+			mu.Lock()
+			dials++
+			mu.Unlock()
+			return dialTestSession(ctx, address)
+		})
+	p.SetBackoff(10*time.Millisecond, time.Second)
+	time.Sleep(500 * time.Millisecond)
+	p.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if dials < 2 || dials > 12 {
+		t.Fatalf("%d dials in 500ms", dials)
+	}
+}
@@ -0,0 +1,279 @@
+package swnet
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrDisconnected means the ReconnectingClient is not connected and can't buffer more packets
+var ErrDisconnected = errors.New("swnet: client disconnected")
+
+const (
+	// DefaultMinBackoff is the default delay before the first redial after a failed dial.
+	DefaultMinBackoff = 100 * time.Millisecond
+	// DefaultMaxBackoff is the default max delay between two redials.
+	DefaultMaxBackoff = 30 * time.Second
+	// StableSessionDuration is how long a session must stay up to reset the backoff.
+	// A session closed earlier, such as by a server accepting and closing at once,
+	// counts as a failed dial.
+	StableSessionDuration = 10 * time.Second
+)
+
+// ReconnectingClient is a client session which redials when the connection drops.
+// Every new Session uses the same PacketProtocol and PacketHandler. Failed dials
+// are retried with jittered exponential backoff.
+type ReconnectingClient struct {
+	network              string
+	address              string
+	options              DialOptions
+	protocol             PacketProtocol
+	handler              PacketHandler
+	sendChanSize         int
+	minBackoff           time.Duration
+	maxBackoff           time.Duration
+	bufferLimit          int
+	connectedCallback    func(*Session)
+	disconnectedCallback func(*Session, error)
+
+	mu       sync.Mutex
+	started  bool
+	closed   bool
+	session  *Session
+	pending  []interface{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	loopDone chan struct{}
+}
+
+// NewReconnectingClient creates a ReconnectingClient, the parameters are same as DialContext.
+// Call Start to begin connecting.
+func NewReconnectingClient(network, address string, options DialOptions,
+	protocol PacketProtocol, handler PacketHandler, sendChanSize int) *ReconnectingClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ReconnectingClient{
+		network:      network,
+		address:      address,
+		options:      options,
+		protocol:     protocol,
+		handler:      handler,
+		sendChanSize: sendChanSize,
+		minBackoff:   DefaultMinBackoff,
+		maxBackoff:   DefaultMaxBackoff,
+		ctx:          ctx,
+		cancel:       cancel,
+		loopDone:     make(chan struct{}),
+	}
+}
+
+// SetBackoff set the min and max delay between redials.
+func (c *ReconnectingClient) SetBackoff(min, max time.Duration) {
+	c.minBackoff = min
+	c.maxBackoff = max
+}
+
+// SetBufferLimit set how many packets AsyncSend can buffer while disconnected.
+// The buffered packets are sent once connected, the ones not sent because the
+// session closed again stay buffered for the next session. Zero disables buffering.
+func (c *ReconnectingClient) SetBufferLimit(limit int) {
+	c.bufferLimit = limit
+}
+
+// SetConnectedCallback can set a callback that be invoked when a new session
+// connected. It is invoked before Session.Start, so the session can be configured.
+func (c *ReconnectingClient) SetConnectedCallback(callback func(*Session)) {
+	c.connectedCallback = callback
+}
+
+// SetDisconnectedCallback can set a callback that be invoked when the session closed,
+// with the reason why the session closed.
+func (c *ReconnectingClient) SetDisconnectedCallback(callback func(*Session, error)) {
+	c.disconnectedCallback = callback
+}
+
+// Start begin connecting in background.
+func (c *ReconnectingClient) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started || c.closed {
+		return
+	}
+	c.started = true
+	go c.run()
+}
+
+// Session return the current session, nil if disconnected.
+func (c *ReconnectingClient) Session() *Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// AsyncSend queue the packet to the current session like Session.AsyncSend.
+// If disconnected, the packet is buffered up to the buffer limit, otherwise
+// return ErrDisconnected. If the client had been closed, return ErrStoped.
+func (c *ReconnectingClient) AsyncSend(packet interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrStoped
+	}
+	if c.session != nil {
+		if err := c.session.AsyncSend(packet); err != ErrStoped {
+			return err
+		}
+	}
+	if len(c.pending) >= c.bufferLimit {
+		return ErrDisconnected
+	}
+	c.pending = append(c.pending, packet)
+	return nil
+}
+
+// Close stops redialing and closes the current session.
+func (c *ReconnectingClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	started := c.started
+	session := c.session
+	c.pending = nil
+	c.mu.Unlock()
+
+	c.cancel()
+	if session != nil {
+		session.Close()
+	}
+	if started {
+		<-c.loopDone
+	}
+	return nil
+}
+
+func (c *ReconnectingClient) run() {
+	defer close(c.loopDone)
+
+	for attempt := 0; ; {
+		session, err := DialContext(c.ctx, c.network, c.address, c.options,
+			c.protocol, c.handler, c.sendChanSize)
+		if err != nil {
+			if !c.sleep(c.backoff(attempt)) {
+				return
+			}
+			attempt++
+			continue
+		}
+		connectedAt := time.Now()
+
+		stopedChan := make(chan struct{})
+		session.addCloseHook(func(*Session, error) {
+			close(stopedChan)
+		})
+		if c.connectedCallback != nil {
+			c.connectedCallback(session)
+		}
+		if !c.attach(session) {
+			session.Close()
+			return
+		}
+
+		<-stopedChan
+		c.mu.Lock()
+		c.session = nil
+		closed := c.closed
+		c.mu.Unlock()
+		if c.disconnectedCallback != nil {
+			c.disconnectedCallback(session, session.Err())
+		}
+		if time.Since(connectedAt) >= StableSessionDuration {
+			attempt = 0
+		}
+		if closed || !c.sleep(c.backoff(attempt)) {
+			return
+		}
+		attempt++
+	}
+}
+
+// attach starts session and sends the buffered packets, return false if the client had been closed.
+// The session is published after the buffered packets are queued, so AsyncSend can't
+// overtake them. Send waits for free space, so no buffered packet is dropped by a
+// full chan of send, the ones left when the session closed are buffered again.
+func (c *ReconnectingClient) attach(session *Session) bool {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return false
+	}
+	session.Start()
+	for len(c.pending) > 0 {
+		pending := c.pending
+		c.pending = nil
+		c.mu.Unlock()
+
+		for i, packet := range pending {
+			if err := session.Send(c.ctx, packet); err != nil {
+				c.mu.Lock()
+				closed := c.closed
+				if !closed {
+					c.pending = append(pending[i:len(pending):len(pending)], c.pending...)
+				}
+				c.mu.Unlock()
+				return !closed
+			}
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return false
+		}
+	}
+	c.session = session
+	c.mu.Unlock()
+	return true
+}
+
+// backoff return the jittered delay before the next redial.
+func (c *ReconnectingClient) backoff(attempt int) time.Duration {
+	return jitteredBackoff(c.minBackoff, c.maxBackoff, attempt)
+}
+
+// jitteredBackoff return a random delay in [d/2, d], d is min doubled by attempt
+// times and capped by max.
+func jitteredBackoff(min, max time.Duration, attempt int) time.Duration {
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// sleep waits for d, return false if the client closed before that.
+func (c *ReconnectingClient) sleep(d time.Duration) bool {
+	return sleepUntil(c.ctx.Done(), d)
+}
+
+// sleepUntil waits for d, return false if done is closed before that.
+func sleepUntil(done <-chan struct{}, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
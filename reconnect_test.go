@@ -0,0 +1,90 @@
+package swnet
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReconnectingClientCloseWithoutStart(t *testing.T) {
+	c := NewReconnectingClient("tcp", "127.0.0.1:1", DialOptions{}, &testProtocol{}, nil, 1)
+	done := make(chan struct{})
+	go func() {
+		c.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close without Start hangs")
+	}
+}
+
+func TestReconnectingClientSendsBufferBeyondSendChan(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Every lane holds one packet, all buffered packets must still be sent in order.
+	c := NewReconnectingClient("tcp", ln.Addr().String(), DialOptions{}, &testProtocol{}, nil, 1)
+	defer c.Close()
+	c.SetBufferLimit(100)
+	want := make([]string, 100)
+	for i := range want {
+		want[i] = fmt.Sprint(i)
+		if err := c.AsyncSend(want[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.AsyncSend("overflow"); err != ErrDisconnected {
+		t.Fatalf("got %v, want %v", err, ErrDisconnected)
+	}
+	c.Start()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if lines := readLines(t, conn, bufio.NewReader(conn), len(want)); !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got %q", lines)
+	}
+}
+
+func TestReconnectingClientBacksOffUnstableSessions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	connected := make(chan struct{}, 100)
+	c := NewReconnectingClient("tcp", ln.Addr().String(), DialOptions{}, &testProtocol{}, nil, 1)
+	c.SetBackoff(10*time.Millisecond, time.Second)
+	c.SetConnectedCallback(func(*Session) {
+		connected <- struct{}{}
+	})
+	c.Start()
+	time.Sleep(500 * time.Millisecond)
+	c.Close()
+
+	// Growing delays of 10ms, 20ms, 40ms... allow about 7 sessions in 500ms,
+	// a constant delay of 10ms would allow about 50.
+	if n := len(connected); n < 2 || n > 12 {
+		t.Fatalf("%d sessions in 500ms", n)
+	}
+}
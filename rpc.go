@@ -0,0 +1,110 @@
+package swnet
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoCorrelator means Session.Call was used without Session.SetCorrelator
+var ErrNoCorrelator = errors.New("swnet: session has no correlator")
+
+// Correlator assigns and extracts the correlation ID of packets, so Session.Call
+// can match a response to its request.
+type Correlator interface {
+	// SetCorrelationID stamps id on the request packet.
+	SetCorrelationID(request interface{}, id uint64)
+	// CorrelationID return the id of a response packet, false if packet is not a response.
+	CorrelationID(packet interface{}) (uint64, bool)
+}
+
+// SetCorrelator enables Session.Call. The responses matching a pending call are
+// consumed by the call and not passed to PacketHandler. It should be called before Start.
+func (s *Session) SetCorrelator(correlator Correlator) {
+	s.correlator = correlator
+}
+
+// Call sends request like Send, then waits for the response with the same
+// correlation ID. If ctx is done first, the call is canceled and return ctx.Err().
+// If the session closed first, return the reason why the session closed.
+// The response is read by recvLoop, so Call must not be made from PacketHandler
+// unless the session uses a WorkerPool, otherwise it waits until ctx is done.
+func (s *Session) Call(ctx context.Context, request interface{}) (interface{}, error) {
+	if s.correlator == nil {
+		return nil, ErrNoCorrelator
+	}
+
+	id := atomic.AddUint64(&s.callID, 1)
+	respChan := make(chan interface{}, 1)
+	s.callMu.Lock()
+	if s.callsClosed {
+		s.callMu.Unlock()
+		return nil, s.Err()
+	}
+	if s.calls == nil {
+		s.calls = make(map[uint64]chan interface{})
+	}
+	s.calls[id] = respChan
+	s.callMu.Unlock()
+
+	s.correlator.SetCorrelationID(request, id)
+	if err := s.Send(ctx, request); err != nil {
+		s.removeCall(id)
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-respChan:
+		if !ok {
+			return nil, s.Err()
+		}
+		return resp, nil
+	case <-ctx.Done():
+		s.removeCall(id)
+		return nil, ctx.Err()
+	}
+}
+
+// CallTimeout is like Call, but waits at most timeout for the response.
+// If timeout elapsed, return context.DeadlineExceeded.
+func (s *Session) CallTimeout(request interface{}, timeout time.Duration) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.Call(ctx, request)
+}
+
+func (s *Session) removeCall(id uint64) {
+	s.callMu.Lock()
+	delete(s.calls, id)
+	s.callMu.Unlock()
+}
+
+// handleResponse delivers packet to its pending call, returns true if packet was consumed.
+func (s *Session) handleResponse(packet interface{}) bool {
+	id, ok := s.correlator.CorrelationID(packet)
+	if !ok {
+		return false
+	}
+	s.callMu.Lock()
+	respChan, ok := s.calls[id]
+	delete(s.calls, id)
+	s.callMu.Unlock()
+	if ok {
+		respChan <- packet
+	}
+	return ok
+}
+
+// failCalls fails all pending calls when the session closed.
+func (s *Session) failCalls() {
+	s.callMu.Lock()
+	calls := s.calls
+	s.calls = nil
+	s.callsClosed = true
+	s.callMu.Unlock()
+
+	for _, respChan := range calls {
+		close(respChan)
+	}
+}
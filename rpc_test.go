@@ -0,0 +1,172 @@
+package swnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rpcPacket is the packet of rpcProtocol, a line "req|resp id body".
+type rpcPacket struct {
+	ID       uint64
+	Response bool
+	Body     string
+}
+
+type rpcProtocol struct {
+	testProtocol
+}
+
+func (p *rpcProtocol) ReadPacket(conn net.Conn, buff []byte) (interface{}, []byte, error) {
+	line, buff, err := p.testProtocol.ReadPacket(conn, buff)
+	if err != nil {
+		return nil, nil, err
+	}
+	var kind string
+	packet := &rpcPacket{}
+	if _, err := fmt.Sscanf(line.(string), "%s %d", &kind, &packet.ID); err != nil {
+		return nil, nil, err
+	}
+	packet.Response = kind == "resp"
+	packet.Body = strings.SplitN(line.(string), " ", 3)[2]
+	return packet, buff, nil
+}
+
+func (p *rpcProtocol) BuildPacket(packet interface{}, buff []byte) ([]byte, error) {
+	rp := packet.(*rpcPacket)
+	kind := "req"
+	if rp.Response {
+		kind = "resp"
+	}
+	return p.testProtocol.BuildPacket(fmt.Sprintf("%s %d %s", kind, rp.ID, rp.Body), buff)
+}
+
+type rpcCorrelator struct{}
+
+func (rpcCorrelator) SetCorrelationID(request interface{}, id uint64) {
+	request.(*rpcPacket).ID = id
+}
+
+func (rpcCorrelator) CorrelationID(packet interface{}) (uint64, bool) {
+	rp := packet.(*rpcPacket)
+	return rp.ID, rp.Response
+}
+
+// newRPCPair returns a client session with a correlator, and starts a server
+// session answering requests with "re:" + body. Requests starting with "late"
+// are answered after 50ms, and "noreply" is never answered.
+func newRPCPair(t *testing.T, handler PacketHandler) *Session {
+	local, remote := newConnPair(t)
+	server := NewSession(remote, &rpcProtocol{}, func(s *Session, packet interface{}) {
+		req := packet.(*rpcPacket)
+		if req.Body == "noreply" {
+			return
+		}
+		if strings.HasPrefix(req.Body, "late") {
+			time.Sleep(50 * time.Millisecond)
+		}
+		s.AsyncSend(&rpcPacket{ID: req.ID, Response: true, Body: "re:" + req.Body})
+	}, 64)
+	server.Start()
+	t.Cleanup(func() { server.Close() })
+
+	client := NewSession(local, &rpcProtocol{}, handler, 64)
+	client.SetCorrelator(rpcCorrelator{})
+	client.Start()
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func pendingCalls(s *Session) int {
+	s.callMu.Lock()
+	defer s.callMu.Unlock()
+	return len(s.calls)
+}
+
+func TestCallMatchesResponses(t *testing.T) {
+	client := newRPCPair(t, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprint(i)
+			if i%4 == 0 {
+				body = fmt.Sprint("late", i)
+			}
+			resp, err := client.CallTimeout(&rpcPacket{Body: body}, 5*time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := resp.(*rpcPacket).Body; got != "re:"+body {
+				t.Errorf("got %q for %q", got, body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := pendingCalls(client); n != 0 {
+		t.Fatalf("%d calls left", n)
+	}
+}
+
+func TestCallFailsWhenSessionClosed(t *testing.T) {
+	client := newRPCPair(t, nil)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.Call(context.Background(), &rpcPacket{Body: "noreply"})
+		result <- err
+	}()
+	for pendingCalls(client) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	client.Close()
+	select {
+	case err := <-result:
+		if err != ErrClosed {
+			t.Fatalf("got %v, want %v", err, ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending call not failed")
+	}
+	if _, err := client.CallTimeout(&rpcPacket{Body: "x"}, time.Second); err != ErrClosed {
+		t.Fatalf("call after close: got %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestCallCanceledIsRemoved(t *testing.T) {
+	lateResponses := make(chan *rpcPacket, 1)
+	client := newRPCPair(t, func(_ *Session, packet interface{}) {
+		lateResponses <- packet.(*rpcPacket)
+	})
+
+	if _, err := client.CallTimeout(&rpcPacket{Body: "late"}, 10*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := pendingCalls(client); n != 0 {
+		t.Fatalf("%d calls left after cancel", n)
+	}
+	// The response of the canceled call is passed to PacketHandler.
+	select {
+	case resp := <-lateResponses:
+		if resp.Body != "re:late" {
+			t.Fatalf("got %q", resp.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("late response lost")
+	}
+}
+
+func TestCallWithoutCorrelator(t *testing.T) {
+	local, _ := newConnPair(t)
+	s := NewSession(local, &rpcProtocol{}, nil, 4)
+	if _, err := s.Call(context.Background(), &rpcPacket{}); err != ErrNoCorrelator {
+		t.Fatalf("got %v, want %v", err, ErrNoCorrelator)
+	}
+}
@@ -0,0 +1,54 @@
+package swnet
+
+import (
+	"context"
+	"sync"
+)
+
+// SendFuture is the result of a packet queued by AsyncSendFuture.
+// It resolves to nil once the packet has been written by PacketWriter.WritePacket,
+// or to the reason why the packet was not written.
+type SendFuture struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newSendFuture() *SendFuture {
+	return &SendFuture{
+		done: make(chan struct{}),
+	}
+}
+
+func (f *SendFuture) resolve(err error) {
+	f.once.Do(func() {
+		f.err = err
+		close(f.done)
+	})
+}
+
+// Done returns a chan that is closed when the future resolved.
+func (f *SendFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the result of the future. If the future is not resolved yet, return nil.
+func (f *SendFuture) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the future resolved and returns the result.
+// If ctx is done before that, return ctx.Err().
+func (f *SendFuture) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,27 +1,92 @@
 package swnet
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Server is tcp server wrapper
+// ErrServerClosed is returned by AcceptLoop after the server was closed by Close or Shutdown
+var ErrServerClosed = errors.New("swnet: server closed")
+
+// RejectReason is why the server rejected an incoming connection.
+type RejectReason int
+
+const (
+	// RejectMaxSessions means the server had reached the max sessions.
+	RejectMaxSessions RejectReason = iota
+	// RejectMaxSessionsPerIP means the remote IP had reached the max sessions per IP.
+	RejectMaxSessionsPerIP
+	// RejectRateLimit means the accept rate limit was exceeded.
+	RejectRateLimit
+	// RejectByHook means the admit hook returned an error.
+	RejectByHook
+
+	rejectReasonCount = int(RejectByHook) + 1
+)
+
+const (
+	// minAcceptDelay and maxAcceptDelay bound the backoff of AcceptLoop after
+	// a temporary accept error, same as net/http.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = 1 * time.Second
+)
+
+// Server is tcp server wrapper. It can accept connections from several listeners,
+// which share the session registry, limits and shutdown.
 type Server struct {
-	listener       net.Listener
-	sendChanSize   int
-	packetHandler  PacketHandler
-	packetProtocol PacketProtocol
+	closed              int32
+	doneChan            chan struct{}
+	listenerMu          sync.Mutex
+	listeners           []net.Listener
+	accepting           int
+	newSessionCallback  func(*Session)
+	acceptWg            sync.WaitGroup
+	acceptErrChan       chan error
+	acceptErrorCallback func(error)
+	handshakeTimeout    time.Duration
+	socketOptions       SocketOptions
+	relisten            func(failed net.Listener) (net.Listener, error)
+	sendChanSize        int
+	overflowPolicy      OverflowPolicy
+	panicHandler        PanicHandler
+	workerPool          *WorkerPool
+	sessionsMu          sync.RWMutex
+	sessions            map[uint64]*Session
+	admitted            int
+	sessionsPerIP       map[string]int
+	maxSessions         int
+	maxPerIP            int
+	acceptLimiter       *tokenBucket
+	admitHook           func(net.Conn) error
+	rejected            [rejectReasonCount]uint64
+	packetHandler       PacketHandler
+	packetProtocol      PacketProtocol
 }
 
 // NewServer creates a Server, you can set PacketProtocol, PacketHandler and
 // the send channel size, so these parameters will be pass to Session.
+// listener can be nil, and listeners can be added by AddListener or Serve.
 func NewServer(listener net.Listener, packetProtocol PacketProtocol,
 	packetHandler PacketHandler, sendChanSize int) *Server {
-	return &Server{
-		listener:       listener,
-		sendChanSize:   sendChanSize,
-		packetHandler:  packetHandler,
-		packetProtocol: packetProtocol,
+	s := &Server{
+		doneChan:         make(chan struct{}),
+		acceptErrChan:    make(chan error, 1),
+		handshakeTimeout: DefaultHandshakeTimeout,
+		sessions:         make(map[uint64]*Session),
+		sessionsPerIP:    make(map[string]int),
+		sendChanSize:     sendChanSize,
+		packetHandler:    packetHandler,
+		packetProtocol:   packetProtocol,
 	}
+	if listener != nil {
+		s.listeners = append(s.listeners, listener)
+	}
+	return s
 }
 
 func Listen(network, address string,
@@ -33,9 +98,157 @@ func Listen(network, address string,
 	return NewServer(listener, protocol, handler, sendChanSize), nil
 }
 
-// Close destory the listener
+// SetOverflowPolicy set the default OverflowPolicy of new sessions.
+func (s *Server) SetOverflowPolicy(policy OverflowPolicy) {
+	s.overflowPolicy = policy
+}
+
+// SetPanicHandler set the PanicHandler of new sessions.
+func (s *Server) SetPanicHandler(handler PanicHandler) {
+	s.panicHandler = handler
+}
+
+// SetWorkerPool set the WorkerPool of new sessions, so all sessions of the server
+// share the pool to handle packets.
+func (s *Server) SetWorkerPool(pool *WorkerPool) {
+	s.workerPool = pool
+}
+
+// SetMaxSessions set the max count of concurrent sessions, zero means no limit.
+func (s *Server) SetMaxSessions(max int) {
+	s.maxSessions = max
+}
+
+// SetMaxSessionsPerIP set the max count of concurrent sessions from one remote IP,
+// zero means no limit. Connections without a remote IP, such as from a unix socket,
+// are not limited by it.
+func (s *Server) SetMaxSessionsPerIP(max int) {
+	s.maxPerIP = max
+}
+
+// SetAcceptRate limits the rate of accepted connections to perSecond, with bursts
+// of at most burst connections. If perSecond <= 0, there is no limit.
+func (s *Server) SetAcceptRate(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		s.acceptLimiter = nil
+		return
+	}
+	s.acceptLimiter = newTokenBucket(perSecond, burst)
+}
+
+// SetAdmitHook can set a hook that is invoked for every incoming connection
+// before a Session is built. If the hook returns an error, the connection is closed.
+func (s *Server) SetAdmitHook(hook func(conn net.Conn) error) {
+	s.admitHook = hook
+}
+
+// Rejected return how many connections had been rejected by reason.
+func (s *Server) Rejected(reason RejectReason) uint64 {
+	if reason < 0 || int(reason) >= rejectReasonCount {
+		return 0
+	}
+	return atomic.LoadUint64(&s.rejected[reason])
+}
+
+// SetAcceptErrorCallback can set a callback to report the errors of accepting
+// connections and of relistening.
+func (s *Server) SetAcceptErrorCallback(callback func(error)) {
+	s.acceptErrorCallback = callback
+}
+
+// SetRelistenFunc makes AcceptLoop survive a non-temporary error of the listener.
+// The failed listener is closed and relisten is called, with backoff, until it
+// returns a new listener, which replaces the failed one.
+func (s *Server) SetRelistenFunc(relisten func(failed net.Listener) (net.Listener, error)) {
+	s.relisten = relisten
+}
+
+// AddListener adds a listener to the server. If AcceptLoop is running, the
+// listener begins to accept at once. If the server had been closed, the listener
+// is closed and return ErrServerClosed.
+func (s *Server) AddListener(listener net.Listener) error {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	if atomic.LoadInt32(&s.closed) != 0 {
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, listener)
+	if s.newSessionCallback != nil {
+		s.goAccept(listener)
+	}
+	return nil
+}
+
+// Listeners return the listeners of the server.
+func (s *Server) Listeners() []net.Listener {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	return append([]net.Listener(nil), s.listeners...)
+}
+
+// Close destory all listeners. The started sessions keep running, use Shutdown
+// to close them too.
 func (s *Server) Close() error {
-	return s.listener.Close()
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil
+	}
+	close(s.doneChan)
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	var err error
+	for _, listener := range s.listeners {
+		if closeErr := listener.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Shutdown stops accepting, gracefully shuts down all sessions of the server by
+// Session.Shutdown, and waits for their goroutines and the accepting goroutines,
+// such as the TLS handshakes in flight, to exit.
+// If ctx expires first, the remaining sessions are closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Close()
+
+	var wg sync.WaitGroup
+	s.Range(func(session *Session) bool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session.Shutdown(ctx)
+			session.loops.Wait()
+		}()
+		return true
+	})
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		s.acceptWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Range(func(session *Session) bool {
+			session.Close()
+			return true
+		})
+		return ctx.Err()
+	}
+}
+
+// Serve adds listeners to the server and runs AcceptLoop.
+func (s *Server) Serve(newSessionCallback func(*Session), listeners ...net.Listener) error {
+	for _, listener := range listeners {
+		if err := s.AddListener(listener); err != nil {
+			return err
+		}
+	}
+	return s.AcceptLoop(newSessionCallback)
 }
 
 // AcceptLoop begin accept connection.
@@ -46,19 +259,323 @@ func (s *Server) Close() error {
 // send buffer size, recv buffer size and so on.
 // If got a new session, but you don't want to start, must call Session.Close to close it.
 // If everything is ok, you must call Session.Start to begin work.
+// Every listener accepts in its own goroutine, so newSessionCallback may be called concurrently.
+// On temporary errors, AcceptLoop retries with exponential backoff. On other errors,
+// the failed listener is closed and removed while the others keep accepting, or it
+// relistens if SetRelistenFunc had been called. The errors are reported by the
+// callback of SetAcceptErrorCallback. When every listener failed, AcceptLoop closes
+// the server and returns the last error. After the server closed, return ErrServerClosed.
 func (s *Server) AcceptLoop(newSessionCallback func(*Session)) error {
-	defer s.Close()
+	s.listenerMu.Lock()
+	s.newSessionCallback = newSessionCallback
+	for _, listener := range s.listeners {
+		s.goAccept(listener)
+	}
+	s.listenerMu.Unlock()
 
+	var err error
+	select {
+	case err = <-s.acceptErrChan:
+	case <-s.doneChan:
+		err = ErrServerClosed
+	}
+	s.Close()
+	s.acceptWg.Wait()
+	return err
+}
+
+// goAccept starts accepting from listener, s.listenerMu must be held.
+func (s *Server) goAccept(listener net.Listener) {
+	s.acceptWg.Add(1)
+	s.accepting++
+	go func() {
+		defer s.acceptWg.Done()
+		err := s.accept(listener)
+
+		s.listenerMu.Lock()
+		s.accepting--
+		last := s.accepting == 0
+		s.listenerMu.Unlock()
+		if err != ErrServerClosed && last {
+			select {
+			case s.acceptErrChan <- err:
+			default:
+			}
+		}
+	}()
+}
+
+// removeListener closes the failed listener and removes it from the server.
+func (s *Server) removeListener(failed net.Listener) {
+	s.listenerMu.Lock()
+	for i := range s.listeners {
+		if s.listeners[i] == failed {
+			s.listeners = append(s.listeners[:i:i], s.listeners[i+1:]...)
+			break
+		}
+	}
+	s.listenerMu.Unlock()
+	failed.Close()
+}
+
+func (s *Server) accept(listener net.Listener) error {
+	var delay time.Duration
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
+			if atomic.LoadInt32(&s.closed) != 0 {
+				return ErrServerClosed
+			}
+			if s.acceptErrorCallback != nil {
+				s.acceptErrorCallback(err)
+			}
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				delay = nextAcceptDelay(delay)
+				if !s.sleep(delay) {
+					return ErrServerClosed
+				}
 				continue
-			} else {
+			}
+			if s.relisten == nil {
+				s.removeListener(listener)
+				return err
+			}
+			if listener, err = s.relistenLoop(listener); err != nil {
 				return err
 			}
+			delay = 0
+			continue
 		}
-		session := NewSession(conn, s.packetProtocol, s.packetHandler, s.sendChanSize)
-		newSessionCallback(session)
+		delay = 0
+		if reason, ok := s.admit(conn); !ok {
+			atomic.AddUint64(&s.rejected[reason], 1)
+			conn.Close()
+			continue
+		}
+		if err = s.socketOptions.apply(conn); err != nil {
+			if s.acceptErrorCallback != nil {
+				s.acceptErrorCallback(err)
+			}
+			s.release(conn)
+			conn.Close()
+			continue
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			s.acceptWg.Add(1)
+			go s.handshake(tlsConn)
+			continue
+		}
+		if !s.serveConn(conn) {
+			return ErrServerClosed
+		}
+	}
+}
+
+// serveConn creates a session for the admitted conn and passes it to the callback
+// of AcceptLoop. If the server had been closed, return false.
+func (s *Server) serveConn(conn net.Conn) bool {
+	session := NewSession(conn, s.packetProtocol, s.packetHandler, s.sendChanSize)
+	session.SetOverflowPolicy(s.overflowPolicy)
+	session.SetPanicHandler(s.panicHandler)
+	session.SetWorkerPool(s.workerPool)
+	if !s.track(session) {
+		s.release(conn)
+		session.Close()
+		return false
+	}
+	s.newSessionCallback(session)
+	return true
+}
+
+// relistenLoop replaces the failed listener by relisten, until it succeeds or
+// the server closed.
+func (s *Server) relistenLoop(failed net.Listener) (net.Listener, error) {
+	failed.Close()
+	for delay := minAcceptDelay; ; delay = nextAcceptDelay(delay) {
+		listener, err := s.relisten(failed)
+		if err == nil {
+			s.listenerMu.Lock()
+			defer s.listenerMu.Unlock()
+			if atomic.LoadInt32(&s.closed) != 0 {
+				listener.Close()
+				return nil, ErrServerClosed
+			}
+			for i := range s.listeners {
+				if s.listeners[i] == failed {
+					s.listeners[i] = listener
+				}
+			}
+			return listener, nil
+		}
+		if s.acceptErrorCallback != nil {
+			s.acceptErrorCallback(err)
+		}
+		if !s.sleep(delay) {
+			return nil, ErrServerClosed
+		}
+	}
+}
+
+// sleep waits for d, return false if the server closed before that.
+func (s *Server) sleep(d time.Duration) bool {
+	return sleepUntil(s.doneChan, d)
+}
+
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minAcceptDelay
+	}
+	if delay *= 2; delay > maxAcceptDelay {
+		delay = maxAcceptDelay
+	}
+	return delay
+}
+
+// Session return the live session of the server by Session.ID, nil if not found.
+func (s *Server) Session(id uint64) *Session {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	return s.sessions[id]
+}
+
+// Range calls fn for each live session of the server. If fn returns false, stop the iteration.
+// fn is called without holding the lock of the registry, so it can close the session.
+func (s *Server) Range(fn func(*Session) bool) {
+	s.sessionsMu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.sessionsMu.RUnlock()
+
+	for _, session := range sessions {
+		if !fn(session) {
+			return
+		}
+	}
+}
+
+// Count return how many live sessions the server has.
+func (s *Server) Count() int {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	return len(s.sessions)
+}
+
+// track adds session to the registry, and removes it when the session closed.
+// If the server had been closed, return false.
+func (s *Server) track(session *Session) bool {
+	s.sessionsMu.Lock()
+	if atomic.LoadInt32(&s.closed) != 0 {
+		s.sessionsMu.Unlock()
+		return false
+	}
+	s.sessions[session.ID()] = session
+	s.sessionsMu.Unlock()
+
+	session.addCloseHook(func(session *Session, err error) {
+		s.sessionsMu.Lock()
+		delete(s.sessions, session.ID())
+		s.sessionsMu.Unlock()
+		s.release(session.RawConn())
+	})
+	return true
+}
+
+// admit checks the accept rate, the admit hook and the session limits for conn.
+// If conn is admitted, it holds a place of the limits until release.
+func (s *Server) admit(conn net.Conn) (RejectReason, bool) {
+	if s.acceptLimiter != nil && !s.acceptLimiter.allow() {
+		return RejectRateLimit, false
+	}
+	if s.admitHook != nil && s.admitHook(conn) != nil {
+		return RejectByHook, false
+	}
+
+	ip := remoteIP(conn)
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if s.maxSessions > 0 && s.admitted >= s.maxSessions {
+		return RejectMaxSessions, false
+	}
+	if ip != "" && s.maxPerIP > 0 && s.sessionsPerIP[ip] >= s.maxPerIP {
+		return RejectMaxSessionsPerIP, false
+	}
+	s.admitted++
+	if ip != "" {
+		s.sessionsPerIP[ip]++
+	}
+	return 0, true
+}
+
+// release gives back the place of conn held by admit.
+func (s *Server) release(conn net.Conn) {
+	ip := remoteIP(conn)
+	s.sessionsMu.Lock()
+	s.admitted--
+	if ip != "" {
+		if s.sessionsPerIP[ip]--; s.sessionsPerIP[ip] <= 0 {
+			delete(s.sessionsPerIP, ip)
+		}
+	}
+	s.sessionsMu.Unlock()
+}
+
+// remoteIP return the IP of the remote of conn, or "" if its address is not
+// an IP address, such as a unix socket.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// tokenBucket is a simple rate limiter.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
 	}
+	b.tokens--
+	return true
 }
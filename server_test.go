@@ -0,0 +1,278 @@
+package swnet
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errTestListener = errors.New("test: listener broken")
+
+// brokenListener fails every Accept with a permanent error.
+type brokenListener struct {
+	closed chan struct{}
+}
+
+func newBrokenListener() *brokenListener {
+	return &brokenListener{closed: make(chan struct{})}
+}
+
+func (l *brokenListener) Accept() (net.Conn, error) {
+	return nil, errTestListener
+}
+
+func (l *brokenListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *brokenListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "broken", Net: "unix"}
+}
+
+// serveTestServer runs AcceptLoop of server, starting every session.
+// It returns the sessions accepted and the result of AcceptLoop.
+func serveTestServer(server *Server) (chan *Session, chan error) {
+	sessions := make(chan *Session, 16)
+	result := make(chan error, 1)
+	go func() {
+		result <- server.AcceptLoop(func(s *Session) {
+			s.Start()
+			sessions <- s
+		})
+	}()
+	return sessions, result
+}
+
+func TestServerKeepsAcceptingWhenOneListenerFails(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := newBrokenListener()
+	server := NewServer(tcp, &testProtocol{}, nil, 4)
+	server.AddListener(broken)
+	acceptErrs := make(chan error, 4)
+	server.SetAcceptErrorCallback(func(err error) {
+		acceptErrs <- err
+	})
+	sessions, result := serveTestServer(server)
+
+	if err := <-acceptErrs; err != errTestListener {
+		t.Fatalf("got %v, want %v", err, errTestListener)
+	}
+	<-broken.closed
+	conn, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case <-sessions:
+	case err := <-result:
+		t.Fatalf("AcceptLoop returned %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session accepted by the healthy listener")
+	}
+	if listeners := server.Listeners(); len(listeners) != 1 || listeners[0] != tcp {
+		t.Fatalf("listeners %v", listeners)
+	}
+
+	server.Close()
+	if err := <-result; err != ErrServerClosed {
+		t.Fatalf("got %v, want %v", err, ErrServerClosed)
+	}
+}
+
+func TestServerAcceptLoopReturnsWhenAllListenersFail(t *testing.T) {
+	server := NewServer(newBrokenListener(), &testProtocol{}, nil, 4)
+	server.AddListener(newBrokenListener())
+	_, result := serveTestServer(server)
+	select {
+	case err := <-result:
+		if err != errTestListener {
+			t.Fatalf("got %v, want %v", err, errTestListener)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AcceptLoop doesn't return without listeners")
+	}
+	if len(server.Listeners()) != 0 {
+		t.Fatalf("listeners %v", server.Listeners())
+	}
+}
+
+// waitServer waits until cond of server is true.
+func waitServer(t *testing.T, server *Server, cond func(*Server) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(server) {
+		if time.Now().After(deadline) {
+			t.Fatalf("server has %d sessions, rejected %d/%d/%d/%d", server.Count(),
+				server.Rejected(RejectMaxSessions), server.Rejected(RejectMaxSessionsPerIP),
+				server.Rejected(RejectRateLimit), server.Rejected(RejectByHook))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// dialTestServer dials the first listener of server n times.
+func dialTestServer(t *testing.T, server *Server, n int) []net.Conn {
+	t.Helper()
+	addr := server.Listeners()[0].Addr()
+	conns := make([]net.Conn, n)
+	for i := range conns {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conns[i] = conn
+	}
+	return conns
+}
+
+func listenTestServer(t *testing.T, network, address string) *Server {
+	t.Helper()
+	server, err := Listen(network, address, &testProtocol{}, nil, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func TestServerMaxSessionsPerIP(t *testing.T) {
+	server := listenTestServer(t, "tcp", "127.0.0.1:0")
+	server.SetMaxSessionsPerIP(2)
+	serveTestServer(server)
+
+	conns := dialTestServer(t, server, 4)
+	waitServer(t, server, func(s *Server) bool {
+		return s.Count() == 2 && s.Rejected(RejectMaxSessionsPerIP) == 2
+	})
+
+	// A closed session gives back its place.
+	for _, conn := range conns {
+		conn.Close()
+	}
+	waitServer(t, server, func(s *Server) bool { return s.Count() == 0 })
+	dialTestServer(t, server, 1)
+	waitServer(t, server, func(s *Server) bool { return s.Count() == 1 })
+	if n := server.Rejected(RejectMaxSessionsPerIP); n != 2 {
+		t.Fatalf("rejected %d", n)
+	}
+}
+
+func TestServerMaxSessionsPerIPSkipsUnixSockets(t *testing.T) {
+	server := listenTestServer(t, "unix", filepath.Join(t.TempDir(), "swnet.sock"))
+	server.SetMaxSessionsPerIP(1)
+	serveTestServer(server)
+
+	dialTestServer(t, server, 3)
+	waitServer(t, server, func(s *Server) bool { return s.Count() == 3 })
+	if n := server.Rejected(RejectMaxSessionsPerIP); n != 0 {
+		t.Fatalf("rejected %d unix connections", n)
+	}
+}
+
+func TestServerMaxSessions(t *testing.T) {
+	server := listenTestServer(t, "tcp", "127.0.0.1:0")
+	server.SetMaxSessions(1)
+	serveTestServer(server)
+
+	dialTestServer(t, server, 3)
+	waitServer(t, server, func(s *Server) bool {
+		return s.Count() == 1 && s.Rejected(RejectMaxSessions) == 2
+	})
+}
+
+func TestServerAcceptRate(t *testing.T) {
+	server := listenTestServer(t, "tcp", "127.0.0.1:0")
+	server.SetAcceptRate(0.001, 2)
+	serveTestServer(server)
+
+	dialTestServer(t, server, 4)
+	waitServer(t, server, func(s *Server) bool {
+		return s.Count() == 2 && s.Rejected(RejectRateLimit) == 2
+	})
+}
+
+func TestServerAdmitHook(t *testing.T) {
+	server := listenTestServer(t, "tcp", "127.0.0.1:0")
+	server.SetAdmitHook(func(net.Conn) error {
+		return errors.New("test: rejected")
+	})
+	serveTestServer(server)
+
+	conns := dialTestServer(t, server, 2)
+	waitServer(t, server, func(s *Server) bool { return s.Rejected(RejectByHook) == 2 })
+	// The rejected connection is closed before a session is built.
+	conns[0].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conns[0].Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want %v", err, io.EOF)
+	}
+	if server.Count() != 0 {
+		t.Fatalf("%d sessions", server.Count())
+	}
+}
+
+func TestServerShutdownWithIdleClient(t *testing.T) {
+	server := listenTestServer(t, "tcp", "127.0.0.1:0")
+	serveTestServer(server)
+	dialTestServer(t, server, 1)
+	waitServer(t, server, func(s *Server) bool { return s.Count() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Count(); n != 0 {
+		t.Fatalf("%d sessions after Shutdown", n)
+	}
+}
+
+func TestServerShutdownWaitsForHandshakes(t *testing.T) {
+	cert, _ := newSelfSignedCert(t, "server.test")
+	server, err := ListenTLS("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}},
+		&testProtocol{}, nil, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// Without a deadline, only Shutdown can end the handshake.
+	server.SetHandshakeTimeout(0)
+	handshakeErrs := make(chan error, 1)
+	server.SetAcceptErrorCallback(func(err error) {
+		handshakeErrs <- err
+	})
+	serveTestServer(server)
+
+	// The client never sends its hello, the handshake waits.
+	dialTestServer(t, server, 1)
+	waitServer(t, server, func(s *Server) bool {
+		s.sessionsMu.Lock()
+		defer s.sessionsMu.Unlock()
+		return s.admitted == 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handshakeErrs:
+	default:
+		t.Fatal("Shutdown returned before the handshake goroutine exited")
+	}
+}
@@ -1,9 +1,12 @@
 package swnet
 
 import (
+	"context"
 	"errors"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var (
@@ -11,6 +14,65 @@ var (
 	ErrStoped = errors.New("swnet: session had stoped")
 	// ErrSendChanBlocking means the chan of send is full
 	ErrSendChanBlocking = errors.New("swnet: Send Channel blocking")
+	// ErrClosed means session was closed by Close or Shutdown
+	ErrClosed = errors.New("swnet: session closed by local")
+	// ErrSlowConsumer means session was closed by OverflowClose because the chan of send is full
+	ErrSlowConsumer = errors.New("swnet: session closed as slow consumer")
+	// ErrPacketDropped means the packet was discarded by OverflowPolicy
+	ErrPacketDropped = errors.New("swnet: packet dropped by overflow policy")
+	// ErrReadTimeout means no packet was read within the read timeout
+	ErrReadTimeout = errors.New("swnet: read timeout")
+	// ErrWriteTimeout means a packet could not be written within the write timeout
+	ErrWriteTimeout = errors.New("swnet: write timeout")
+	// ErrIdleTimeout means nothing was read or written within the idle timeout
+	ErrIdleTimeout = errors.New("swnet: idle timeout")
+)
+
+// OverflowPolicy decides what AsyncSend does when the chan of send is full.
+type OverflowPolicy int
+
+const (
+	// OverflowFail makes AsyncSend return ErrSendChanBlocking, it is the default policy.
+	OverflowFail OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued packet to make room for the new one.
+	// If the chan of send has no buffer, it fails like OverflowFail.
+	OverflowDropOldest
+	// OverflowDropNewest silently discards the new packet.
+	OverflowDropNewest
+	// OverflowBlock makes AsyncSend wait for free space like Send.
+	OverflowBlock
+	// OverflowClose closes the session with ErrSlowConsumer.
+	OverflowClose
+)
+
+// Priority is the lane of the send queue a packet is queued to.
+// sendLoop always sends packets of higher lanes first.
+type Priority int
+
+const (
+	// PriorityHigh is for keepalives and control replies.
+	PriorityHigh Priority = iota
+	// PriorityNormal is the priority of AsyncSend.
+	PriorityNormal
+	// PriorityLow is for bulk data.
+	PriorityLow
+
+	priorityCount = int(PriorityLow) + 1
+)
+
+// shutdownLinger is how long Shutdown waits for the remote to close after the
+// write side was half-closed.
+const shutdownLinger = 100 * time.Millisecond
+
+// starvationLimit is how many packets of higher lanes can be sent in a row
+// while the lowest lane is waiting.
+const starvationLimit = 32
+
+const (
+	// DefaultBatchCount is the default max count of packets written by one PacketBatchWriter call.
+	DefaultBatchCount = 64
+	// DefaultBatchBytes is the default max bytes written by one PacketBatchWriter call.
+	DefaultBatchBytes = 64 * 1024
 )
 
 // PacketHandler is used to process packet that recved from remote session
@@ -21,7 +83,8 @@ type PacketHandler func(s *Session, packet interface{})
 // PacketReader is used to unmarshal a complete packet from buff
 type PacketReader interface {
 	// Read data from conn and build a complete packet.
-	// How to read from conn is up to you. You can set read timeout or other option.
+	// How to read from conn is up to you. You can set read timeout or other option,
+	// or let Session set the read deadline by Session.SetReadTimeout.
 	// If buff's capacity is small, you can make a new buff, then return it,
 	// so can reuse to reduce memory overhead.
 	ReadPacket(conn net.Conn, buff []byte) (interface{}, []byte, error)
@@ -33,48 +96,129 @@ type PacketWriter interface {
 	// and return it to reuse.
 	BuildPacket(packet interface{}, buff []byte) ([]byte, error)
 
-	// How to write data to conn is up to you. So you can set write timeout or other option.
+	// How to write data to conn is up to you. So you can set write timeout or other option,
+	// or let Session set the write deadline by Session.SetWriteTimeout.
 	WritePacket(conn net.Conn, buff []byte) error
 }
 
+// PacketBatchWriter can be implemented by a PacketWriter to write several built
+// packets with one call, for example a vectored write by net.Buffers.
+// If implemented, Session coalesces the queued packets and calls WritePackets
+// instead of WritePacket.
+type PacketBatchWriter interface {
+	// Write all buffs to conn. buffs is only valid during the call.
+	WritePackets(conn net.Conn, buffs net.Buffers) error
+}
+
 // PacketProtocol just a composite interface
 type PacketProtocol interface {
 	PacketReader
 	PacketWriter
 }
 
+// ProtocolFactory can be implemented by a PacketProtocol which keeps state per
+// connection, for example a buffered reader. NewSession and SetProtocol call
+// NewProtocol so every session gets its own instance.
+type ProtocolFactory interface {
+	NewProtocol() PacketProtocol
+}
+
+func newProtocol(protocol PacketProtocol) PacketProtocol {
+	if factory, ok := protocol.(ProtocolFactory); ok {
+		return factory.NewProtocol()
+	}
+	return protocol
+}
+
+// sendRequest is an item in the chan of send.
+type sendRequest struct {
+	packet   interface{}
+	built    []byte
+	future   *SendFuture
+	priority Priority
+}
+
+func (r sendRequest) resolve(err error) {
+	if r.future != nil {
+		r.future.resolve(err)
+	}
+}
+
+// sessionID is the last ID allocated for a Session.
+var sessionID uint64
+
 // Session is a tcp connection wrapper. It recved data in silence, and
 // queue data to send.
 type Session struct {
+	id             uint64
 	closed         int32
 	conn           net.Conn
-	sendChan       chan interface{}
+	sendChans      [priorityCount]chan sendRequest
+	sendMu         sync.RWMutex
 	stopedChan     chan struct{}
-	closeCallback  func(*Session)
+	closingChan    chan struct{}
+	closingOnce    sync.Once
+	flushedChan    chan struct{}
+	loops          sync.WaitGroup
+	errMu          sync.Mutex
+	err            error
+	closeCallback  func(*Session, error)
+	hookMu         sync.Mutex
+	hookID         uint64
+	hooksFired     bool
+	closeHooks     map[uint64]func(*Session, error)
 	sendCallback   func(*Session, interface{})
+	overflowPolicy OverflowPolicy
+	dropped        uint64
+	batchCount     int
+	batchBytes     int
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	lastActive     int64
+	heartbeat      *Heartbeat
+	heartbeatMu    sync.Mutex
+	missedPings    int
+	pingsSentAt    []time.Time
+	rtt            int64
+	correlator     Correlator
+	callID         uint64
+	callMu         sync.Mutex
+	callsClosed    bool
+	calls          map[uint64]chan interface{}
 	packetHandler  PacketHandler
+	panicHandler   PanicHandler
+	workerPool     *WorkerPool
 	packetProtocol PacketProtocol
 }
 
 // NewSession new a session. You can set PacketProtocol, PacketHandler. and you can set
 // the chan size of send to ensure fairness.
 func NewSession(conn net.Conn, protocol PacketProtocol, handler PacketHandler, sendChanSize int) *Session {
-	return &Session{
+	s := &Session{
+		id:             atomic.AddUint64(&sessionID, 1),
 		closed:         -1,
 		conn:           conn,
 		stopedChan:     make(chan struct{}),
-		sendChan:       make(chan interface{}, sendChanSize),
+		closingChan:    make(chan struct{}),
+		flushedChan:    make(chan struct{}),
+		batchCount:     DefaultBatchCount,
+		batchBytes:     DefaultBatchBytes,
 		packetHandler:  handler,
-		packetProtocol: protocol,
+		packetProtocol: newProtocol(protocol),
 	}
+	s.SetSendChanSize(sendChanSize)
+	return s
 }
 
+// Dial connects to address and creates a session, see DialContext for more options.
 func Dial(network, address string, protocol PacketProtocol, handler PacketHandler, sendChanSize int) (*Session, error) {
-	conn, err := net.Dial(network, address)
-	if err != nil {
-		return nil, err
-	}
-	return NewSession(conn, protocol, handler, sendChanSize), nil
+	return DialContext(context.Background(), network, address, DialOptions{}, protocol, handler, sendChanSize)
+}
+
+// ID return the unique ID of the session in this process.
+func (s *Session) ID() uint64 {
+	return s.id
 }
 
 // RawConn return net.Conn, so you can set/get parameter with it
@@ -83,19 +227,106 @@ func (s *Session) RawConn() net.Conn {
 }
 
 // Close the session, destory other resource.
+// Packets still queued in the chan of send are dropped, use Shutdown to flush them.
 func (s *Session) Close() error {
-	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+	return s.CloseWithError(ErrClosed)
+}
+
+// CloseWithError closes the session like Close, and records err as the reason
+// if no reason had been recorded yet.
+func (s *Session) CloseWithError(err error) error {
+	s.setErr(err)
+	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) || atomic.CompareAndSwapInt32(&s.closed, -1, 1) {
 		s.conn.Close()
 		close(s.stopedChan)
+		s.discardQueued()
+		s.failCalls()
+		s.fireCloseHooks()
 		if s.closeCallback != nil {
-			s.closeCallback(s)
+			s.closeCallback(s, s.Err())
 		}
 	}
 	return nil
 }
 
+// discardQueued resolves the futures of packets left in the chan of send with ErrStoped.
+func (s *Session) discardQueued() {
+	// Wait for the in-flight AsyncSend, no more packets can be queued after this.
+	s.sendMu.Lock()
+	s.sendMu.Unlock()
+
+	for _, sendChan := range s.sendChans {
+	L:
+		for {
+			select {
+			case req := <-sendChan:
+				req.resolve(ErrStoped)
+			default:
+				break L
+			}
+		}
+	}
+}
+
+// addCloseHook adds fn to be invoked when the session closed, before the close
+// callback. If the session had been closed, fn is invoked at once.
+// It returns an id to remove the hook by removeCloseHook.
+func (s *Session) addCloseHook(fn func(*Session, error)) uint64 {
+	s.hookMu.Lock()
+	if s.hooksFired {
+		s.hookMu.Unlock()
+		fn(s, s.Err())
+		return 0
+	}
+	s.hookID++
+	if s.closeHooks == nil {
+		s.closeHooks = make(map[uint64]func(*Session, error))
+	}
+	s.closeHooks[s.hookID] = fn
+	id := s.hookID
+	s.hookMu.Unlock()
+	return id
+}
+
+func (s *Session) removeCloseHook(id uint64) {
+	s.hookMu.Lock()
+	delete(s.closeHooks, id)
+	s.hookMu.Unlock()
+}
+
+func (s *Session) fireCloseHooks() {
+	s.hookMu.Lock()
+	hooks := s.closeHooks
+	s.closeHooks = nil
+	s.hooksFired = true
+	s.hookMu.Unlock()
+
+	err := s.Err()
+	for _, hook := range hooks {
+		hook(s, err)
+	}
+}
+
+// Err returns the reason why the session stopped, such as io.EOF, the error returned
+// by PacketProtocol, or ErrClosed. It returns nil while the session is alive.
+func (s *Session) Err() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+// setErr records err if it is the first terminating error.
+func (s *Session) setErr(err error) {
+	s.errMu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.errMu.Unlock()
+}
+
 // SetCloseCallback can set a callback that be invoked when session closed.
-func (s *Session) SetCloseCallback(callback func(*Session)) {
+// The callback receives the reason why the session closed, same as Session.Err.
+func (s *Session) SetCloseCallback(callback func(*Session, error)) {
 	s.closeCallback = callback
 }
 
@@ -112,84 +343,540 @@ func (s *Session) SetPacketHandler(handler PacketHandler) {
 
 // SetProtocol can set a new PacketProtocol.
 func (s *Session) SetProtocol(protocol PacketProtocol) {
-	s.packetProtocol = protocol
+	s.packetProtocol = newProtocol(protocol)
 }
 
-// SetSendChanSize can change the chan size of send
+// SetSendChanSize can change the chan size of send, every priority lane has
+// its own chan of this size.
 func (s *Session) SetSendChanSize(chanSize int) {
-	s.sendChan = make(chan interface{}, chanSize)
+	for i := range s.sendChans {
+		s.sendChans[i] = make(chan sendRequest, chanSize)
+	}
+}
+
+// SetOverflowPolicy can change what AsyncSend does when the chan of send is full.
+func (s *Session) SetOverflowPolicy(policy OverflowPolicy) {
+	s.overflowPolicy = policy
+}
+
+// GetOverflowPolicy return the overflow policy of the chan of send
+func (s *Session) GetOverflowPolicy() OverflowPolicy {
+	return s.overflowPolicy
+}
+
+// DroppedCount return how many packets had been discarded by OverflowDropOldest
+// or OverflowDropNewest.
+func (s *Session) DroppedCount() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// SetBatchLimit can change how many packets and bytes are coalesced into one
+// write when PacketProtocol implements PacketBatchWriter. A batch stops growing
+// once either limit is reached. If maxCount <= 1, coalescing is disabled.
+func (s *Session) SetBatchLimit(maxCount, maxBytes int) {
+	s.batchCount = maxCount
+	s.batchBytes = maxBytes
+}
+
+// SetReadTimeout sets the read deadline before every PacketReader.ReadPacket.
+// If no packet is read within timeout, the session is closed with ErrReadTimeout.
+// Zero means no timeout. It should be called before Start.
+func (s *Session) SetReadTimeout(timeout time.Duration) {
+	s.readTimeout = timeout
+}
+
+// SetWriteTimeout sets the write deadline before every PacketWriter.WritePacket.
+// If a write times out, the session is closed with ErrWriteTimeout.
+// Zero means no timeout. It should be called before Start.
+func (s *Session) SetWriteTimeout(timeout time.Duration) {
+	s.writeTimeout = timeout
+}
+
+// SetIdleTimeout closes the session with ErrIdleTimeout if no packet is read or
+// written within timeout. Zero means no timeout. It should be called before Start.
+func (s *Session) SetIdleTimeout(timeout time.Duration) {
+	s.idleTimeout = timeout
 }
 
 // GetSendChanSize return the chan size of send
 func (s *Session) GetSendChanSize() int {
-	return cap(s.sendChan)
+	return cap(s.sendChans[PriorityNormal])
+}
+
+// GetSendQueueLen return how many packets are waiting in all lanes of the chan of send
+func (s *Session) GetSendQueueLen() int {
+	n := 0
+	for _, sendChan := range s.sendChans {
+		n += len(sendChan)
+	}
+	return n
 }
 
 // Start can call when new session created by server or a client session to start
 func (s *Session) Start() {
 	if atomic.CompareAndSwapInt32(&s.closed, -1, 0) {
-		go s.sendLoop()
-		go s.recvLoop()
+		s.active()
+		s.goLoop(s.sendLoop)
+		s.goLoop(s.recvLoop)
+		if s.idleTimeout > 0 {
+			s.goLoop(s.idleLoop)
+		}
+		if s.heartbeat != nil && s.heartbeat.Interval > 0 && s.heartbeat.NewPing != nil && s.heartbeat.IsPong != nil {
+			s.goLoop(s.heartbeatLoop)
+		}
 	}
 }
 
-func (s *Session) recvLoop() {
-	defer s.Close()
+func (s *Session) goLoop(loop func()) {
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		loop()
+	}()
+}
 
+func (s *Session) recvLoop() {
 	var recvBuff []byte
 	var packet interface{}
 	var err error
 	for {
+		if s.readTimeout > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.readTimeout))
+		}
 		packet, recvBuff, err = s.packetProtocol.ReadPacket(s.conn, recvBuff)
 		if err != nil {
-			break
+			if isTimeout(err) && s.readTimeout > 0 {
+				err = ErrReadTimeout
+			}
+			s.CloseWithError(err)
+			return
+		}
+		s.active()
+		if s.heartbeat != nil && s.handleHeartbeat(packet) {
+			continue
+		}
+		if s.correlator != nil && s.handleResponse(packet) {
+			continue
+		}
+		if s.workerPool == nil || !s.workerPool.dispatch(s, packet) {
+			s.handlePacket(packet)
 		}
-		s.packetHandler(s, packet)
 	}
 }
 
-func (s *Session) sendLoop() {
-	defer s.Close()
+// Shutdown gracefully closes the session. It stops accepting new packets, waits
+// until all queued packets have been written, half-closes the write side of the
+// connection and then closes the session, after waiting at most a short linger
+// for the remote to close its side.
+// If ctx expires first, the session is closed immediately and ctx.Err() is returned.
+// If the session stopped before all queued packets were written, return ErrStoped.
+// It should not be called from PacketHandler, the close of the remote can't be read
+// while the handler runs, so it always waits the whole linger.
+func (s *Session) Shutdown(ctx context.Context) error {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return s.Close()
+	}
+	s.setErr(ErrClosed)
+	s.closingOnce.Do(func() {
+		close(s.closingChan)
+	})
 
-	var sendBuff []byte
-	var err error
+	select {
+	case <-s.flushedChan:
+	case <-s.stopedChan:
+		select {
+		case <-s.flushedChan:
+			return nil
+		default:
+			return ErrStoped
+		}
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+
+	// Closing with unread data resets the connection, and the remote may lose the
+	// packets just written, so give it a moment to close first.
+	timer := time.NewTimer(shutdownLinger)
+	defer timer.Stop()
+	select {
+	case <-s.stopedChan:
+	case <-timer.C:
+		s.Close()
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+	return nil
+}
+
+// sendState is the state kept by sendLoop between packets.
+type sendState struct {
+	starved int
+	reqs    []sendRequest
+	buffs   [][]byte
+	vec     net.Buffers
+}
+
+func (s *Session) sendLoop() {
+	var state sendState
 
 	for {
-		select {
-		case packet, ok := <-s.sendChan:
-			{
-				if !ok {
+		req, ok := s.pollRequest(&state.starved)
+		if !ok {
+			select {
+			case req = <-s.sendChans[PriorityHigh]:
+			case req = <-s.sendChans[PriorityNormal]:
+			case req = <-s.sendChans[PriorityLow]:
+			case <-s.closingChan:
+				{
+					s.flush(&state)
 					return
 				}
-
-				if sendBuff, err = s.packetProtocol.BuildPacket(packet, sendBuff); err == nil {
-					err = s.packetProtocol.WritePacket(s.conn, sendBuff)
-				}
-				if err != nil {
+			case <-s.stopedChan:
+				{
 					return
 				}
-				if s.sendCallback != nil {
-					s.sendCallback(s, packet)
-				}
 			}
-		case <-s.stopedChan:
-			{
+		}
+		if err := s.send(req, &state); err != nil {
+			s.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// pollRequest takes the next queued packet without blocking, higher lanes first.
+// starved counts the packets taken from higher lanes while the lowest lane is
+// waiting, once it reaches starvationLimit the lowest lane is served first.
+func (s *Session) pollRequest(starved *int) (sendRequest, bool) {
+	lowChan := s.sendChans[priorityCount-1]
+	if *starved >= starvationLimit {
+		*starved = 0
+		select {
+		case req := <-lowChan:
+			return req, true
+		default:
+		}
+	}
+	for i, sendChan := range s.sendChans {
+		select {
+		case req := <-sendChan:
+			if i < priorityCount-1 && len(lowChan) > 0 {
+				*starved++
+			} else {
+				*starved = 0
+			}
+			return req, true
+		default:
+		}
+	}
+	return sendRequest{}, false
+}
+
+// send writes req. If PacketProtocol implements PacketBatchWriter, the packets
+// currently queued are written together with req, up to the batch limit.
+func (s *Session) send(req sendRequest, state *sendState) error {
+	if len(state.buffs) == 0 {
+		state.buffs = make([][]byte, 1)
+	}
+	batchWriter, ok := s.packetProtocol.(PacketBatchWriter)
+	if !ok || s.batchCount <= 1 {
+		return s.sendPacket(req, state)
+	}
+
+	state.reqs = append(state.reqs[:0], req)
+	state.vec = state.vec[:0]
+	var err error
+	var size int
+	for n := 0; ; n++ {
+		buff := state.reqs[n].built
+		if buff == nil {
+			// Packets of Group.Broadcast are built already and take no buffer,
+			// so state.buffs may be shorter than n.
+			for len(state.buffs) <= n {
+				state.buffs = append(state.buffs, nil)
+			}
+			if state.buffs[n], err = s.packetProtocol.BuildPacket(state.reqs[n].packet, state.buffs[n]); err != nil {
+				break
+			}
+			buff = state.buffs[n]
+		}
+		// WriteTo of net.Buffers consumes the slice, so never pass state.buffs directly.
+		state.vec = append(state.vec, buff)
+		size += len(buff)
+		if len(state.reqs) >= s.batchCount || size >= s.batchBytes {
+			break
+		}
+		if req, ok = s.pollRequest(&state.starved); !ok {
+			break
+		}
+		state.reqs = append(state.reqs, req)
+	}
+
+	built := len(state.reqs)
+	if err != nil {
+		built--
+		for _, req := range state.reqs[built:] {
+			req.resolve(err)
+		}
+	}
+	if built > 0 {
+		s.setWriteDeadline()
+		writeErr := s.writeError(batchWriter.WritePackets(s.conn, state.vec))
+		for _, req := range state.reqs[:built] {
+			req.resolve(writeErr)
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+		if s.sendCallback != nil {
+			for _, req := range state.reqs[:built] {
+				s.sendCallback(s, req.packet)
+			}
+		}
+	}
+	for i := range state.reqs {
+		state.reqs[i] = sendRequest{}
+	}
+	return err
+}
+
+func (s *Session) sendPacket(req sendRequest, state *sendState) error {
+	var err error
+	buff := req.built
+	if buff == nil {
+		state.buffs[0], err = s.packetProtocol.BuildPacket(req.packet, state.buffs[0])
+		buff = state.buffs[0]
+	}
+	if err == nil {
+		s.setWriteDeadline()
+		err = s.writeError(s.packetProtocol.WritePacket(s.conn, buff))
+	}
+	req.resolve(err)
+	if err != nil {
+		return err
+	}
+	if s.sendCallback != nil {
+		s.sendCallback(s, req.packet)
+	}
+	return nil
+}
+
+func (s *Session) setWriteDeadline() {
+	if s.writeTimeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+}
+
+// writeError turns a write timeout to ErrWriteTimeout, and marks the session
+// active if the write succeeded.
+func (s *Session) writeError(err error) error {
+	if err == nil {
+		s.active()
+		return nil
+	}
+	if isTimeout(err) && s.writeTimeout > 0 {
+		return ErrWriteTimeout
+	}
+	return err
+}
+
+// active records the time of the last read or write.
+func (s *Session) active() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *Session) idleLoop() {
+	timer := time.NewTimer(s.idleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+			if idle >= s.idleTimeout {
+				s.CloseWithError(ErrIdleTimeout)
 				return
 			}
+			timer.Reset(s.idleTimeout - idle)
+		case <-s.stopedChan:
+			return
 		}
 	}
 }
 
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// flush writes all packets left in the chan of send, then half-closes the
+// connection. If the connection can't be half-closed, the session is closed.
+func (s *Session) flush(state *sendState) {
+	// Wait for the in-flight AsyncSend, no more packets can be queued after this.
+	s.sendMu.Lock()
+	s.sendMu.Unlock()
+
+	for {
+		req, ok := s.pollRequest(&state.starved)
+		if !ok {
+			break
+		}
+		if err := s.send(req, state); err != nil {
+			s.CloseWithError(err)
+			return
+		}
+	}
+
+	close(s.flushedChan)
+	if cw, ok := s.conn.(interface {
+		CloseWrite() error
+	}); !ok || cw.CloseWrite() != nil {
+		s.Close()
+	}
+}
+
 // AsyncSend queue the packet to the chan of send,
-// if the send channel is full, return ErrSendChanBlocking.
-// if the session had been closed, return ErrStoped
+// if the send channel is full, the behavior is decided by OverflowPolicy,
+// by default return ErrSendChanBlocking.
+// if the session had been closed or is shutting down, return ErrStoped
 func (s *Session) AsyncSend(packet interface{}) error {
+	return s.queue(sendRequest{packet: packet, priority: PriorityNormal})
+}
+
+// AsyncSendPriority is like AsyncSend, but queue the packet to the lane of priority.
+// A priority out of range is treated as PriorityLow.
+func (s *Session) AsyncSendPriority(packet interface{}, priority Priority) error {
+	if priority < PriorityHigh || int(priority) >= priorityCount {
+		priority = PriorityLow
+	}
+	return s.queue(sendRequest{packet: packet, priority: priority})
+}
+
+// AsyncSendFuture is like AsyncSend, but returns a SendFuture that resolves to nil
+// once the packet has been written, or to the error why it was not written,
+// such as ErrStoped when the session closed before the packet was sent.
+// If the packet can't be queued, the returned future is already resolved.
+func (s *Session) AsyncSendFuture(packet interface{}) *SendFuture {
+	future := newSendFuture()
+	if err := s.queue(sendRequest{packet: packet, future: future, priority: PriorityNormal}); err != nil {
+		future.resolve(err)
+	}
+	return future
+}
+
+func (s *Session) queue(req sendRequest) error {
+	err := s.enqueue(req)
+	if err == ErrSlowConsumer {
+		s.CloseWithError(err)
+	}
+	return err
+}
+
+func (s *Session) enqueue(req sendRequest) error {
+	s.sendMu.RLock()
+	defer s.sendMu.RUnlock()
+
+	sendChan := s.sendChans[req.priority]
+
 	select {
-	case s.sendChan <- packet:
+	case <-s.closingChan:
+		return ErrStoped
 	case <-s.stopedChan:
 		return ErrStoped
+	default:
+	}
+	select {
+	case sendChan <- req:
+		return nil
+	default:
+	}
+
+	switch s.overflowPolicy {
+	case OverflowDropOldest:
+		// A chan without buffer has no oldest packet to drop.
+		if cap(sendChan) == 0 {
+			return ErrSendChanBlocking
+		}
+		for {
+			select {
+			case <-s.closingChan:
+				return ErrStoped
+			case <-s.stopedChan:
+				return ErrStoped
+			case sendChan <- req:
+				return nil
+			default:
+			}
+			select {
+			case oldest := <-sendChan:
+				atomic.AddUint64(&s.dropped, 1)
+				oldest.resolve(ErrPacketDropped)
+			default:
+				return ErrSendChanBlocking
+			}
+		}
+	case OverflowDropNewest:
+		atomic.AddUint64(&s.dropped, 1)
+		req.resolve(ErrPacketDropped)
+		return nil
+	case OverflowBlock:
+		select {
+		case sendChan <- req:
+			return nil
+		case <-s.stopedChan:
+			return ErrStoped
+		case <-s.closingChan:
+			return ErrStoped
+		}
+	case OverflowClose:
+		return ErrSlowConsumer
 	default:
 		return ErrSendChanBlocking
 	}
+}
+
+// Send queue the packet to the chan of send, and waits for free space if the
+// send channel is full.
+// If ctx is done before the packet queued, return ctx.Err().
+// if the session had been closed or is shutting down, return ErrStoped
+func (s *Session) Send(ctx context.Context, packet interface{}) error {
+	return s.SendPriority(ctx, packet, PriorityNormal)
+}
+
+// SendPriority is like Send, but queues the packet to the lane of priority.
+func (s *Session) SendPriority(ctx context.Context, packet interface{}, priority Priority) error {
+	if priority < PriorityHigh || int(priority) >= priorityCount {
+		priority = PriorityLow
+	}
+
+	s.sendMu.RLock()
+	defer s.sendMu.RUnlock()
+
+	select {
+	case <-s.closingChan:
+		return ErrStoped
+	case <-s.stopedChan:
+		return ErrStoped
+	default:
+	}
+	select {
+	case s.sendChans[priority] <- sendRequest{packet: packet, priority: priority}:
+	case <-s.stopedChan:
+		return ErrStoped
+	case <-s.closingChan:
+		return ErrStoped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	return nil
 }
+
+// SendTimeout is like Send, but waits at most timeout for free space.
+// If timeout elapsed, return context.DeadlineExceeded.
+func (s *Session) SendTimeout(packet interface{}, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.Send(ctx, packet)
+}
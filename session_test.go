@@ -0,0 +1,255 @@
+package swnet
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queueAndStart queues packets before starting s, so sendLoop finds them all
+// queued and batches them by the limits.
+func queueAndStart(t *testing.T, s *Session, packets ...string) []*SendFuture {
+	t.Helper()
+	futures := make([]*SendFuture, len(packets))
+	for i, packet := range packets {
+		futures[i] = s.AsyncSendFuture(packet)
+	}
+	s.Start()
+	return futures
+}
+
+func TestSessionBatchCountLimit(t *testing.T) {
+	local, remote := newConnPair(t)
+	protocol := &batchProtocol{}
+	s := NewSession(local, protocol, nil, 16)
+	defer s.Close()
+	s.SetBatchLimit(4, 1<<20)
+
+	packets := make([]string, 10)
+	for i := range packets {
+		packets[i] = fmt.Sprint(i)
+	}
+	futures := queueAndStart(t, s, packets...)
+	if lines := readLines(t, remote, bufio.NewReader(remote), len(packets)); !reflect.DeepEqual(lines, packets) {
+		t.Fatalf("got %q, want %q", lines, packets)
+	}
+	for _, f := range futures {
+		if err := f.Wait(testContext(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if batches := protocol.Batches(); !reflect.DeepEqual(batches, []int{4, 4, 2}) {
+		t.Fatalf("batches %v", batches)
+	}
+}
+
+func TestSessionBatchBytesLimit(t *testing.T) {
+	local, remote := newConnPair(t)
+	protocol := &batchProtocol{}
+	s := NewSession(local, protocol, nil, 16)
+	defer s.Close()
+	// Every packet is 5 bytes with '\n', a batch is full after 2 packets.
+	s.SetBatchLimit(64, 10)
+
+	futures := queueAndStart(t, s, "aaaa", "bbbb", "cccc", "dddd", "eeee")
+	readLines(t, remote, bufio.NewReader(remote), len(futures))
+	for _, f := range futures {
+		if err := f.Wait(testContext(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if batches := protocol.Batches(); !reflect.DeepEqual(batches, []int{2, 2, 1}) {
+		t.Fatalf("batches %v", batches)
+	}
+}
+
+func TestSessionBatchDisabled(t *testing.T) {
+	local, remote := newConnPair(t)
+	protocol := &batchProtocol{}
+	s := NewSession(local, protocol, nil, 16)
+	defer s.Close()
+	s.SetBatchLimit(1, 1<<20)
+
+	futures := queueAndStart(t, s, "a", "b", "c")
+	readLines(t, remote, bufio.NewReader(remote), len(futures))
+	if batches := protocol.Batches(); len(batches) != 0 {
+		t.Fatalf("WritePackets called with coalescing disabled: %v", batches)
+	}
+}
+
+func TestSessionBatchBuildError(t *testing.T) {
+	local, remote := newConnPair(t)
+	protocol := &batchProtocol{testProtocol: testProtocol{failPacket: "bad"}}
+	s := NewSession(local, protocol, nil, 16)
+	defer s.Close()
+
+	futures := queueAndStart(t, s, "a", "b", "bad", "c")
+
+	// The packets built before the failure are still written, then the
+	// session is closed with the error of BuildPacket.
+	r := bufio.NewReader(remote)
+	if lines := readLines(t, remote, r, 2); !reflect.DeepEqual(lines, []string{"a", "b"}) {
+		t.Fatalf("got %q", lines)
+	}
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if rest, err := io.ReadAll(r); err != nil || len(rest) != 0 {
+		t.Fatalf("got %q after failed packet, err %v", rest, err)
+	}
+
+	want := []error{nil, nil, errTestBuild, ErrStoped}
+	for i, f := range futures {
+		if err := f.Wait(testContext(t)); err != want[i] {
+			t.Fatalf("future %d: got %v, want %v", i, err, want[i])
+		}
+	}
+	if err := s.Err(); err != errTestBuild {
+		t.Fatalf("session error %v", err)
+	}
+	if batches := protocol.Batches(); !reflect.DeepEqual(batches, []int{2}) {
+		t.Fatalf("batches %v", batches)
+	}
+}
+
+func TestSessionBatchPrebuiltAndBuildError(t *testing.T) {
+	local, remote := newConnPair(t)
+	protocol := &batchProtocol{testProtocol: testProtocol{failPacket: "bad"}}
+	s := NewSession(local, protocol, nil, 16)
+	defer s.Close()
+
+	g := NewGroup(protocol)
+	g.Join(s)
+	g.Broadcast("b1")
+	f1 := s.AsyncSendFuture("a")
+	g.Broadcast("b2")
+	f2 := s.AsyncSendFuture("bad")
+	s.Start()
+
+	if lines := readLines(t, remote, bufio.NewReader(remote), 3); !reflect.DeepEqual(lines, []string{"b1", "a", "b2"}) {
+		t.Fatalf("got %q", lines)
+	}
+	if err := f1.Wait(testContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f2.Wait(testContext(t)); err != errTestBuild {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionOverflowDropOldest(t *testing.T) {
+	local, remote := newConnPair(t)
+	s := NewSession(local, &testProtocol{}, nil, 2)
+	s.SetOverflowPolicy(OverflowDropOldest)
+
+	futures := []*SendFuture{s.AsyncSendFuture("a"), s.AsyncSendFuture("b"), s.AsyncSendFuture("c")}
+	if err := futures[0].Wait(testContext(t)); err != ErrPacketDropped {
+		t.Fatalf("got %v, want %v", err, ErrPacketDropped)
+	}
+	if n := s.DroppedCount(); n != 1 {
+		t.Fatalf("dropped %d", n)
+	}
+	s.Start()
+	defer s.Close()
+	if lines := readLines(t, remote, bufio.NewReader(remote), 2); !reflect.DeepEqual(lines, []string{"b", "c"}) {
+		t.Fatalf("got %q", lines)
+	}
+}
+
+func TestSessionOverflowDropOldestWithoutBuffer(t *testing.T) {
+	local, _ := newConnPair(t)
+	s := NewSession(local, &testProtocol{}, nil, 0)
+	s.SetOverflowPolicy(OverflowDropOldest)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.AsyncSend("a")
+	}()
+	select {
+	case err := <-done:
+		if err != ErrSendChanBlocking {
+			t.Fatalf("got %v, want %v", err, ErrSendChanBlocking)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AsyncSend spins on a chan without buffer")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hangs")
+	}
+}
+
+func TestSessionShutdownFlushesQueued(t *testing.T) {
+	local, remote := newConnPair(t)
+	s := NewSession(local, &testProtocol{}, nil, 128)
+	want := make([]string, 100)
+	for i := range want {
+		want[i] = fmt.Sprint(i)
+		if err := s.AsyncSend(want[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Start()
+
+	// The remote never closes its side, Shutdown still returns.
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	r := bufio.NewReader(remote)
+	if lines := readLines(t, remote, r, len(want)); !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got %q", lines)
+	}
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("got %v, want %v", err, io.EOF)
+	}
+	if err := s.AsyncSend("late"); err != ErrStoped {
+		t.Fatalf("got %v, want %v", err, ErrStoped)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown waits for the remote to close")
+	}
+	if err := s.Err(); err != ErrClosed {
+		t.Fatalf("got %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestSessionShutdownFromHandler(t *testing.T) {
+	local, remote := newConnPair(t)
+	done := make(chan error, 1)
+	s := NewSession(local, &testProtocol{}, func(s *Session, packet interface{}) {
+		s.AsyncSend("bye")
+		done <- s.Shutdown(context.Background())
+	}, 4)
+	s.Start()
+
+	if _, err := remote.Write([]byte("quit\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown from PacketHandler hangs")
+	}
+	if lines := readLines(t, remote, bufio.NewReader(remote), 1); lines[0] != "bye" {
+		t.Fatalf("got %q", lines)
+	}
+}
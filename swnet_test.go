@@ -0,0 +1,120 @@
+package swnet
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTestBuild = errors.New("test: build failed")
+
+// testProtocol frames string packets by '\n'. It records the packet count of
+// every WritePackets call and fails BuildPacket of failPacket.
+type testProtocol struct {
+	batch      bool
+	failPacket string
+
+	mu      sync.Mutex
+	batches []int
+}
+
+func (p *testProtocol) ReadPacket(conn net.Conn, buff []byte) (interface{}, []byte, error) {
+	buff = buff[:0]
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return nil, nil, err
+		}
+		if b[0] == '\n' {
+			return string(buff), buff, nil
+		}
+		buff = append(buff, b[0])
+	}
+}
+
+func (p *testProtocol) BuildPacket(packet interface{}, buff []byte) ([]byte, error) {
+	if packet == p.failPacket {
+		return nil, errTestBuild
+	}
+	return append(append(buff[:0], packet.(string)...), '\n'), nil
+}
+
+func (p *testProtocol) WritePacket(conn net.Conn, buff []byte) error {
+	_, err := conn.Write(buff)
+	return err
+}
+
+func (p *testProtocol) Batches() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]int(nil), p.batches...)
+}
+
+// batchProtocol is a testProtocol implementing PacketBatchWriter.
+type batchProtocol struct {
+	testProtocol
+}
+
+func (p *batchProtocol) WritePackets(conn net.Conn, buffs net.Buffers) error {
+	p.mu.Lock()
+	p.batches = append(p.batches, len(buffs))
+	p.mu.Unlock()
+	_, err := buffs.WriteTo(conn)
+	return err
+}
+
+// newConnPair returns both ends of a loopback TCP connection.
+func newConnPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// readLines reads n lines from r, failing the test after a timeout.
+func readLines(t *testing.T, conn net.Conn, r *bufio.Reader, n int) []string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	lines := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read line %d: %v", i, err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	return lines
+}
+
+// testContext returns a context cancelled after a timeout or when the test ends.
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
@@ -0,0 +1,78 @@
+package swnet
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+)
+
+// DefaultHandshakeTimeout is the default timeout of TLS handshake of accepted connections.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// ListenTLS is like Listen, but the accepted connections are encrypted by TLS with config.
+// The handshake is completed before the session is passed to the callback of
+// AcceptLoop, so Session.ConnectionState can be used to authorize the remote.
+func ListenTLS(network, address string, config *tls.Config,
+	protocol PacketProtocol, handler PacketHandler, sendChanSize int) (*Server, error) {
+	listener, err := tls.Listen(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(listener, protocol, handler, sendChanSize), nil
+}
+
+// DialTLS is like Dial, but the connection is encrypted by TLS with config.
+func DialTLS(network, address string, config *tls.Config,
+	protocol PacketProtocol, handler PacketHandler, sendChanSize int) (*Session, error) {
+	options := DialOptions{TLSConfig: config}
+	return DialContext(context.Background(), network, address, options, protocol, handler, sendChanSize)
+}
+
+// ConnectionState return the TLS connection state, such as the peer certificates
+// and the negotiated protocol of ALPN. If the session is not a TLS session, return false.
+func (s *Session) ConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := s.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// SetHandshakeTimeout set the timeout of TLS handshake of accepted connections.
+// If timeout <= 0, the handshake has no deadline.
+func (s *Server) SetHandshakeTimeout(timeout time.Duration) {
+	s.handshakeTimeout = timeout
+}
+
+// handshake completes the TLS handshake of conn and then serves it.
+// It runs in its own goroutine so a slow handshake doesn't block accepting,
+// and the handshake is interrupted when the server closed.
+func (s *Server) handshake(conn *tls.Conn) {
+	defer s.acceptWg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.doneChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if s.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		if s.acceptErrorCallback != nil {
+			s.acceptErrorCallback(err)
+		}
+		s.release(conn)
+		conn.Close()
+		return
+	}
+	if s.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	s.serveConn(conn)
+}
@@ -0,0 +1,120 @@
+package swnet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newSelfSignedCert generates a self-signed certificate for name, and a pool
+// trusting it.
+func newSelfSignedCert(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestMutualTLS(t *testing.T) {
+	for _, timeout := range []time.Duration{DefaultHandshakeTimeout, 0} {
+		testMutualTLS(t, timeout)
+	}
+}
+
+func testMutualTLS(t *testing.T, handshakeTimeout time.Duration) {
+	serverCert, serverPool := newSelfSignedCert(t, "server.test")
+	clientCert, clientPool := newSelfSignedCert(t, "client.test")
+
+	server, err := ListenTLS("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		NextProtos:   []string{"swnet"},
+	}, &testProtocol{}, func(s *Session, packet interface{}) {
+		s.AsyncSend("echo " + packet.(string))
+	}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetHandshakeTimeout(handshakeTimeout)
+
+	states := make(chan tls.ConnectionState, 1)
+	go server.AcceptLoop(func(s *Session) {
+		state, ok := s.ConnectionState()
+		if !ok {
+			t.Error("accepted session is not a TLS session")
+		}
+		states <- state
+		s.Start()
+	})
+
+	replies := make(chan interface{}, 1)
+	client, err := DialTLS("tcp", server.Listeners()[0].Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      serverPool,
+		ServerName:   "server.test",
+		NextProtos:   []string{"swnet"},
+	}, &testProtocol{}, func(_ *Session, packet interface{}) {
+		replies <- packet
+	}, 4)
+	if err != nil {
+		t.Fatalf("handshake timeout %v: %v", handshakeTimeout, err)
+	}
+	defer client.Close()
+	client.Start()
+
+	select {
+	case state := <-states:
+		if len(state.PeerCertificates) != 1 || state.PeerCertificates[0].Subject.CommonName != "client.test" {
+			t.Fatalf("unexpected peer certificates %v", state.PeerCertificates)
+		}
+		if state.NegotiatedProtocol != "swnet" {
+			t.Fatalf("negotiated protocol %q", state.NegotiatedProtocol)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handshake timeout %v: no session accepted", handshakeTimeout)
+	}
+	if state, ok := client.ConnectionState(); !ok || !state.HandshakeComplete {
+		t.Fatal("client handshake not complete")
+	}
+
+	client.AsyncSend("hi")
+	select {
+	case reply := <-replies:
+		if reply != "echo hi" {
+			t.Fatalf("got %q", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+	}
+}
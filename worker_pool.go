@@ -0,0 +1,81 @@
+package swnet
+
+import (
+	"sync"
+)
+
+// WorkerPool runs PacketHandler of sessions on a fixed number of goroutines, so
+// a slow handler doesn't stall reading and the total handler concurrency is bounded.
+// Packets of the same session are always handled by the same worker in order,
+// while packets of different sessions are handled in parallel.
+type WorkerPool struct {
+	rwlock sync.RWMutex
+	closed bool
+	queues []chan poolTask
+	wg     sync.WaitGroup
+}
+
+type poolTask struct {
+	session *Session
+	packet  interface{}
+}
+
+// NewWorkerPool creates a WorkerPool with workers goroutines, every worker has
+// a queue of queueSize packets. When the queue is full, the recvLoop of the
+// session waits, so reading from the connection is slowed down.
+func NewWorkerPool(workers, queueSize int) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &WorkerPool{
+		queues: make([]chan poolTask, workers),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan poolTask, queueSize)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+// Close stops the workers after the queued packets handled.
+// Sessions using a closed WorkerPool handle packets in their recvLoop.
+func (p *WorkerPool) Close() {
+	p.rwlock.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.rwlock.Unlock()
+	p.wg.Wait()
+}
+
+// dispatch queues packet to the worker of session, return false if the pool was closed.
+// If the session stopped while waiting for the queue, the packet is dropped.
+func (p *WorkerPool) dispatch(s *Session, packet interface{}) bool {
+	p.rwlock.RLock()
+	defer p.rwlock.RUnlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.queues[s.id%uint64(len(p.queues))] <- poolTask{session: s, packet: packet}:
+	case <-s.stopedChan:
+	}
+	return true
+}
+
+func (p *WorkerPool) work(queue chan poolTask) {
+	defer p.wg.Done()
+	for task := range queue {
+		task.session.handlePacket(task.packet)
+	}
+}
+
+// SetWorkerPool makes the session handle packets on pool instead of its recvLoop.
+// It should be called before Start.
+func (s *Session) SetWorkerPool(pool *WorkerPool) {
+	s.workerPool = pool
+}
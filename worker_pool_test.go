@@ -0,0 +1,43 @@
+package swnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolDispatchStopsWithSession(t *testing.T) {
+	pool := NewWorkerPool(1, 0)
+	release := make(chan struct{})
+	defer func() {
+		close(release)
+		pool.Close()
+	}()
+
+	local, remote := newConnPair(t)
+	handled := make(chan struct{}, 1)
+	s := NewSession(local, &testProtocol{}, func(*Session, interface{}) {
+		handled <- struct{}{}
+		<-release
+	}, 4)
+	s.SetWorkerPool(pool)
+	s.Start()
+
+	// The only worker is stuck in the first packet, recvLoop waits to dispatch the second.
+	if _, err := remote.Write([]byte("a\nb\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-handled
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+
+	stoped := make(chan struct{})
+	go func() {
+		s.loops.Wait()
+		close(stoped)
+	}()
+	select {
+	case <-stoped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recvLoop blocked by a busy worker after Close")
+	}
+}